@@ -0,0 +1,330 @@
+package stp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 管理接口 /api/v1, 使用 Authorization: Bearer <token> 认证, token 和客户端 authKey 分开配置
+// /showClient, /exec 等接口配置了 token 时同样需要 token, 否则只接受本机请求
+// admin socket 上的请求由 socket 文件权限控制, 不需要 token
+// 返回的结构只增加字段, 不修改和删除已有字段
+
+// APIForward 客户端的一个转发目标
+type APIForward struct {
+	Label string `json:"label"`
+	Addr  string `json:"addr"`
+	Port  string `json:"port"` // 未分配时为空
+}
+
+// APIClient 客户端信息
+type APIClient struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Online    bool         `json:"online"`
+	Addr      string       `json:"addr"`
+	Transport string       `json:"transport"`
+	OnDemand  bool         `json:"onDemand"`
+	Active    bool         `json:"active"`
+	Forwards  []APIForward `json:"forwards"`
+	LoginTime int64        `json:"loginTime"`
+	LastSeen  int64        `json:"lastSeen"`
+	Traffic   *STPTraffic  `json:"traffic,omitempty"`
+}
+
+// APIClientList GET /api/v1/clients
+type APIClientList struct {
+	Clients []APIClient `json:"clients"`
+}
+
+// APIPort 端口池中已分配或固定的端口
+type APIPort struct {
+	Port   int    `json:"port"`
+	Used   bool   `json:"used"`
+	Pinned string `json:"pinned"` // 固定给的客户端名
+	Client string `json:"client"` // 正在使用的在线客户端 id
+}
+
+// APIPortPool GET /api/v1/ports
+type APIPortPool struct {
+	Start  int       `json:"start"`
+	End    int       `json:"end"`
+	Total  int       `json:"total"`
+	Used   int       `json:"used"`
+	Pinned int       `json:"pinned"`
+	Ports  []APIPort `json:"ports"`
+}
+
+// APIResult 操作结果
+type APIResult struct {
+	Result string     `json:"result"`
+	Client *APIClient `json:"client,omitempty"`
+	Port   *APIPort   `json:"port,omitempty"`
+}
+
+// APIError 错误响应
+type APIError struct {
+	Error string `json:"error"`
+}
+
+func newAPIClient(cli *Client) APIClient {
+	forwards := []APIForward{}
+	for _, target := range cli.Targets {
+		forwards = append(forwards, APIForward{Label: target.Label, Addr: target.Addr, Port: target.Port})
+	}
+	return APIClient{
+		ID:        cli.ID,
+		Name:      cli.Name,
+		Online:    cli.IsOnline,
+		Addr:      cli.Addr,
+		Transport: cli.Transport,
+		OnDemand:  cli.OnDemand,
+		Active:    cli.Active,
+		Forwards:  forwards,
+		LoginTime: cli.LoginTime,
+		LastSeen:  cli.LastSeen,
+		Traffic:   cli.Traffic,
+	}
+}
+
+// UseAPITokens 设置管理接口的 bearer token, 为空时关闭 /api/v1, 其他管理接口只接受本机请求
+func (s *STPServer) UseAPITokens(tokens []string) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	s.apiTokens = tokens
+}
+
+// OnReload 设置 POST /api/v1/reload 时重新加载配置的函数
+func (s *STPServer) OnReload(fn func() error) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	s.onReload = fn
+}
+
+// apiAuth 校验 bearer token
+func (s *STPServer) apiAuth(r *http.Request) (int, string) {
+	s.cfgLock.RLock()
+	tokens := s.apiTokens
+	s.cfgLock.RUnlock()
+	if len(tokens) == 0 {
+		return http.StatusForbidden, "api disabled, apiTokens not configured"
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return http.StatusUnauthorized, "bearer token required"
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, allowed := range tokens {
+		if subtle.ConstantTimeCompare(token, []byte(allowed)) == 1 {
+			return http.StatusOK, ""
+		}
+	}
+	log.Println("invalid api token from", r.RemoteAddr)
+	return http.StatusUnauthorized, "invalid token"
+}
+
+// localRequest 请求是否来自本机
+func localRequest(r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminOnly 管理接口认证, 配置了 apiTokens 时需要 bearer token, 否则只接受本机请求
+// public 为 true 时挂在 listenAddr 上, 反向代理转发的请求也来自本机, 只接受 token
+func (s *STPServer) adminOnly(handler http.HandlerFunc, public bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.cfgLock.RLock()
+		hasTokens := len(s.apiTokens) > 0
+		s.cfgLock.RUnlock()
+		switch {
+		case hasTokens:
+			if status, msg := s.apiAuth(r); status != http.StatusOK {
+				writeAPIError(w, status, msg)
+				return
+			}
+		case public:
+			log.Println("admin request on listen addr from", r.RemoteAddr, "denied, apiTokens not configured")
+			http.Error(w, "admin api on listen addr requires apiTokens, or use adminListen", http.StatusForbidden)
+			return
+		case !localRequest(r):
+			log.Println("admin request from", r.RemoteAddr, "denied")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeAPI(w, status, &APIError{Error: msg})
+}
+
+// APIHandler /api/v1/ 管理接口
+//
+//	GET  /api/v1/clients
+//	GET  /api/v1/clients/<id|name>
+//	POST /api/v1/clients/<id|name>/kick
+//	POST /api/v1/clients/<id|name>/relogin
+//	POST /api/v1/clients/<id|name>/activate
+//	GET  /api/v1/ports
+//	POST /api/v1/ports/<port>/release
+//	POST /api/v1/reload
+func (s *STPServer) APIHandler(w http.ResponseWriter, r *http.Request) {
+	if status, msg := s.apiAuth(r); status != http.StatusOK {
+		writeAPIError(w, status, msg)
+		return
+	}
+	s.serveAPI(w, r)
+}
+
+// serveAPI 不校验 token, admin socket 使用
+func (s *STPServer) serveAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/"), "/")
+	method := r.Method
+	switch {
+	case parts[0] == "clients" && len(parts) == 1 && method == http.MethodGet:
+		clients := []APIClient{}
+		for _, cli := range s.cliMgr.List() {
+			clients = append(clients, newAPIClient(cli))
+		}
+		writeAPI(w, http.StatusOK, &APIClientList{Clients: clients})
+	case parts[0] == "clients" && len(parts) == 2 && method == http.MethodGet:
+		cli, err := FindClient(s.cliMgr.List(), parts[1])
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		client := newAPIClient(cli)
+		writeAPI(w, http.StatusOK, &client)
+	case parts[0] == "clients" && len(parts) == 3 && method == http.MethodPost:
+		s.apiClientAction(w, parts[1], parts[2])
+	case parts[0] == "ports" && len(parts) == 1 && method == http.MethodGet:
+		writeAPI(w, http.StatusOK, s.portPool())
+	case parts[0] == "ports" && len(parts) == 3 && parts[2] == "release" && method == http.MethodPost:
+		s.apiReleasePort(w, parts[1])
+	case parts[0] == "reload" && len(parts) == 1 && method == http.MethodPost:
+		s.cfgLock.RLock()
+		reload := s.onReload
+		s.cfgLock.RUnlock()
+		if reload == nil {
+			writeAPIError(w, http.StatusNotImplemented, "reload not supported")
+			return
+		}
+		err := reload()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Println("config reloaded by api")
+		writeAPI(w, http.StatusOK, &APIResult{Result: "reloaded"})
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("%s %s not found", method, r.URL.Path))
+	}
+}
+
+func (s *STPServer) apiClientAction(w http.ResponseWriter, key, action string) {
+	cli, err := FindClient(s.cliMgr.Sessions(), key)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("%s, or offline", err.Error()))
+		return
+	}
+	switch action {
+	case "kick":
+		log.Println("kick client by api:", cli.Name, cli.Addr)
+		s.kick(cli, nil, "kicked by admin")
+	case "relogin":
+		log.Println("relogin client by api:", cli.Name, cli.Addr)
+		s.setOffline(cli, "relogin by admin", true)
+	case "activate":
+		snapshot, err := s.Activate(cli.ID)
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		client := newAPIClient(snapshot)
+		writeAPI(w, http.StatusOK, &APIResult{Result: "activated", Client: &client})
+		return
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("unknown action %s", action))
+		return
+	}
+	// 下线后的快照
+	client := APIClient{ID: cli.ID, Name: cli.Name}
+	if offline, err := FindClient(s.cliMgr.List(), cli.Name); err == nil {
+		client = newAPIClient(offline)
+	}
+	writeAPI(w, http.StatusOK, &APIResult{Result: action, Client: &client})
+}
+
+// portPool 端口池使用情况, 只列出已分配或固定的端口
+func (s *STPServer) portPool() *APIPortPool {
+	users := make(map[int]string)
+	for _, cli := range s.cliMgr.List() {
+		if !cli.IsOnline {
+			continue
+		}
+		for _, target := range cli.Targets {
+			if port, err := strconv.Atoi(target.Port); err == nil {
+				users[port] = cli.ID
+			}
+		}
+	}
+	pool := &APIPortPool{Start: s.portMgr.StartPort, End: s.portMgr.EndPort, Ports: []APIPort{}}
+	pool.Total = pool.End - pool.Start + 1
+	for _, p := range s.portMgr.Usage() {
+		if p.used {
+			pool.Used++
+		}
+		if p.owner != "" {
+			pool.Pinned++
+		}
+		pool.Ports = append(pool.Ports, APIPort{Port: p.port, Used: p.used, Pinned: p.owner, Client: users[p.port]})
+	}
+	return pool
+}
+
+// apiReleasePort 释放没有在线客户端使用的端口, 并从离线客户端的记录中删除
+func (s *STPServer) apiReleasePort(w http.ResponseWriter, portStr string) {
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < s.portMgr.StartPort || port > s.portMgr.EndPort {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid port %s", portStr))
+		return
+	}
+	for _, cli := range s.cliMgr.List() {
+		if !cli.IsOnline {
+			continue
+		}
+		for _, target := range cli.Targets {
+			if target.Port == portStr {
+				writeAPIError(w, http.StatusConflict, fmt.Sprintf("port %s used by online client %s(%s), kick it first", portStr, cli.Name, cli.ID))
+				return
+			}
+		}
+	}
+	log.Println("release port by api:", port)
+	s.portMgr.ReleasePort(portStr)
+	s.cliMgr.ForgetPort(portStr)
+	result := &APIResult{Result: "released", Port: &APIPort{Port: port}}
+	for _, p := range s.portMgr.Usage() {
+		if p.port == port {
+			result.Port.Used, result.Port.Pinned = p.used, p.owner
+		}
+	}
+	writeAPI(w, http.StatusOK, result)
+}
@@ -0,0 +1,56 @@
+package stp
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// DupNameReject 同名客户端在线时拒绝登录
+	DupNameReject = "reject"
+	// DupNameReplace 踢掉在线的同名客户端
+	DupNameReplace = "replace"
+	// DupNameSuffix 自动加序号, 如 name-2
+	DupNameSuffix = "suffix"
+
+	// 登录结果中的名字处理方式
+	NameAccepted = "accepted"
+	NameReplaced = "replaced"
+	NameSuffixed = "suffixed"
+
+	maxClientName = 64
+)
+
+var clientNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ValidClientName 客户端名只能包含字母、数字和 . _ -, 以字母或数字开头, 最长 64 个字符
+func ValidClientName(name string) error {
+	if name == "" {
+		return fmt.Errorf("client name is required")
+	}
+	if len(name) > maxClientName {
+		return fmt.Errorf("client name too long, max %d", maxClientName)
+	}
+	if !clientNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid client name %q, only letters, digits, '.', '_' and '-' are allowed", name)
+	}
+	return nil
+}
+
+// suffixName 名字加序号, 超长时先截断名字, 结果不超过 maxClientName
+func suffixName(name string, n int) string {
+	suffix := fmt.Sprintf("-%d", n)
+	if len(name)+len(suffix) > maxClientName {
+		name = name[:maxClientName-len(suffix)]
+	}
+	return name + suffix
+}
+
+// ValidDupNamePolicy 检查同名客户端处理方式
+func ValidDupNamePolicy(policy string) error {
+	switch policy {
+	case DupNameReject, DupNameReplace, DupNameSuffix:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate name policy %q, use %s, %s or %s", policy, DupNameReject, DupNameReplace, DupNameSuffix)
+}
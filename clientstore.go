@@ -0,0 +1,82 @@
+package stp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ClientRecord 客户端注册信息, 客户端离线和 stpsrv 重启后依然保留
+type ClientRecord struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Port      string       `json:"port"`
+	Targets   []*STPTarget `json:"targets"`
+	Addr      string       `json:"addr"`
+	LoginTime int64        `json:"loginTime"`
+	LastSeen  int64        `json:"lastSeen"`
+	Traffic   *STPTraffic  `json:"traffic,omitempty"` // 最后一次上报的流量
+}
+
+// ClientStore 客户端注册信息持久化接口
+type ClientStore interface {
+	Load() (map[string]*ClientRecord, error)
+	Save(records map[string]*ClientRecord) error
+}
+
+// JSONClientStore 把客户端注册信息保存在 json 文件中
+type JSONClientStore struct {
+	path string
+	lock sync.Mutex
+}
+
+type clientStoreState struct {
+	Clients map[string]*ClientRecord `json:"clients"`
+}
+
+func NewJSONClientStore(path string) *JSONClientStore {
+	return &JSONClientStore{path: path}
+}
+
+func (js *JSONClientStore) Load() (map[string]*ClientRecord, error) {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	records := make(map[string]*ClientRecord)
+	data, err := ioutil.ReadFile(js.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return records, nil
+	}
+	state := clientStoreState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Clients != nil {
+		records = state.Clients
+	}
+	return records, nil
+}
+
+func (js *JSONClientStore) Save(records map[string]*ClientRecord) error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	data, err := json.MarshalIndent(clientStoreState{Clients: records}, "", "    ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再重命名, 避免写一半时退出把状态文件写坏
+	tmp := filepath.Join(filepath.Dir(js.path), "."+filepath.Base(js.path)+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, js.path)
+}
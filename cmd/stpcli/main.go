@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/takama/daemon"
@@ -16,7 +18,8 @@ const (
 	// VERSION 0.0.1
 	// 0.0.2 clean offline tunnel
 	// 0.0.3 service supported
-	VERSION = "0.0.3"
+	// 0.0.4 protocol version negotiation
+	VERSION = "0.0.4"
 
 	name        = "stpcli"
 	description = "stpcli quickly create ssh tunnel"
@@ -29,7 +32,7 @@ func main() {
 		showVersion bool
 		name        string // client name
 		serverUrl   string
-		localPort   string
+		forwards    string
 		authKey     string
 		install     bool
 		uninstall   bool
@@ -38,12 +41,23 @@ func main() {
 		start       bool
 		status      bool
 		logfile     string
+		knownHosts  string
+		hostKey     string
+		caFile      string
+		certFile    string
+		keyFile     string
+		certPin     string
+		transport   string
+		execFile    string
+		fileRoot    string
+		onDemand    bool
+		rate        string
 	)
 	flag.BoolVar(&showVersion, "v", false, "show version")
 	flag.StringVar(&name, "n", "", "client name")
 	flag.StringVar(&serverUrl, "h", "ws://127.0.0.1:10000", "stp server connect url")
-	flag.StringVar(&localPort, "p", "22", "stp local forward port")
-	flag.StringVar(&authKey, "key", "tunnelkey", "stp auth key")
+	flag.StringVar(&forwards, "p", "22", "stp forward targets, comma separated [label=][host:]port, eg 22,web=80,cam=192.168.1.20:554")
+	flag.StringVar(&authKey, "key", "", "stp auth key or client token")
 	flag.BoolVar(&install, "install", false, "install service")
 	flag.BoolVar(&uninstall, "uninstall", false, "uninstall service")
 	flag.BoolVar(&background, "d", false, "run as daemon service")
@@ -51,6 +65,17 @@ func main() {
 	flag.BoolVar(&start, "start", false, "start stpcli service")
 	flag.BoolVar(&status, "status", false, "status stpcli service")
 	flag.StringVar(&logfile, "logfile", "/var/log/stpcli.log", "stpcli service log")
+	flag.StringVar(&knownHosts, "known", stp.DefaultKnownHostsPath(), "known hosts file to pin stp server ssh host key")
+	flag.StringVar(&hostKey, "hostkey", "", "trust only this stp server ssh host key fingerprint, eg SHA256:xxx")
+	flag.StringVar(&caFile, "ca", "", "CA bundle to verify wss server certificate, default system CAs")
+	flag.StringVar(&certFile, "cert", "", "client certificate for wss mutual auth")
+	flag.StringVar(&keyFile, "certkey", "", "client certificate key for wss mutual auth")
+	flag.StringVar(&certPin, "pin", "", "wss server certificate public key sha256 pin, base64")
+	flag.StringVar(&transport, "transport", stp.TransportSSH, "forward transport, ws or ssh")
+	flag.StringVar(&execFile, "exec", "", "allowlist file of commands stpsrv can exec, one per line, empty disable exec")
+	flag.StringVar(&fileRoot, "root", "", "root dir stpsrv can push/pull files, empty disable file transfer")
+	flag.BoolVar(&onDemand, "ondemand", false, "only keep control connection, open tunnel when stpsrv needs it")
+	flag.StringVar(&rate, "rate", "", "rate limit of all tunnels, bytes per second up/down, eg 512K/2M, stricter limit from stpsrv wins")
 	flag.Parse()
 
 	if len(os.Args) == 1 {
@@ -108,12 +133,75 @@ func main() {
 		return
 	}
 
-	if name == "" || serverUrl == "" {
-		log.Println("need name or serverUrl")
+	if name == "" || serverUrl == "" || authKey == "" {
+		log.Println("need name, serverUrl or auth key")
+		return
+	}
+	if err := stp.ValidClientName(name); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if transport != stp.TransportSSH && transport != stp.TransportWs {
+		log.Println("invalid transport", transport)
+		return
+	}
+
+	targets, err := stp.ParseTargets(forwards)
+	if err != nil {
+		log.Println(err.Error())
 		return
 	}
 
-	args := []string{"-h", serverUrl, "-key", authKey, "-p", localPort, "-n", name}
+	// service working dir is different
+	for _, path := range []*string{&knownHosts, &caFile, &certFile, &keyFile} {
+		if *path != "" {
+			*path, _ = filepath.Abs(*path)
+		}
+	}
+	args := []string{"-h", serverUrl, "-key", authKey, "-p", forwards, "-n", name, "-known", knownHosts, "-transport", transport}
+	if hostKey != "" {
+		args = append(args, "-hostkey", hostKey)
+	}
+	if caFile != "" {
+		args = append(args, "-ca", caFile)
+	}
+	if certFile != "" {
+		args = append(args, "-cert", certFile, "-certkey", keyFile)
+	}
+	if certPin != "" {
+		args = append(args, "-pin", certPin)
+	}
+	execAllow := []string{}
+	if execFile != "" {
+		execAllow, err = stp.LoadExecAllowlist(execFile)
+		if err != nil {
+			log.Println("load exec allowlist error", err.Error())
+			return
+		}
+		// service working dir is different
+		execFile, _ = filepath.Abs(execFile)
+		args = append(args, "-exec", execFile)
+	}
+	if fileRoot != "" {
+		info, err := os.Stat(fileRoot)
+		if err != nil || !info.IsDir() {
+			log.Println("invalid file root", fileRoot)
+			return
+		}
+		fileRoot, _ = filepath.Abs(fileRoot)
+		args = append(args, "-root", fileRoot)
+	}
+	if onDemand {
+		args = append(args, "-ondemand")
+	}
+	rateLimit, err := stp.ParseRateLimit(rate)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if rate != "" {
+		args = append(args, "-rate", rate)
+	}
 	if install {
 		status, err := service.Install(args...)
 		log.Println(status)
@@ -138,7 +226,21 @@ func main() {
 		return
 	}
 	// retry forever
-	cli := stp.NewSTPClient(authKey, serverUrl, localPort, name)
+	cli := stp.NewSTPClient(authKey, serverUrl, targets, name)
+	cli.PinHostKey(knownHosts, hostKey)
+	cli.UseTransport(transport)
+	cli.AllowExec(execAllow)
+	cli.UseFileRoot(fileRoot)
+	cli.UseOnDemand(onDemand)
+	cli.UseRateLimit(rateLimit)
+	if strings.HasPrefix(serverUrl, "wss://") {
+		tlsConfig, err := stp.NewClientTLSConfig(caFile, certFile, keyFile, certPin)
+		if err != nil {
+			log.Println("load tls config error", err.Error())
+			return
+		}
+		cli.UseTLS(tlsConfig)
+	}
 	for {
 		err := cli.Login()
 		if err != nil {
@@ -147,7 +249,9 @@ func main() {
 			log.Printf("retry login")
 			continue
 		} else {
-			cli.Daemon()
+			err = cli.Daemon()
+			log.Println(err.Error())
+			return
 		}
 	}
 }
@@ -5,15 +5,42 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 )
 
 type GlobalConfig struct {
-	AuthKey     string `json:"authKey"`
-	ListentAddr string `json:"listenAddr"`
-	SSHAddr     string `json:"sshAddr"`
-	SSHUser     string `json:"sshUser"`
-	SSHRSAPath  string `json:"sshRsaPath"`
-	PortRange   string `json:"portRange"`
+	AuthKey     string         `json:"authKey"`
+	ListentAddr string         `json:"listenAddr"`
+	SSHAddr     string         `json:"sshAddr"`
+	SSHUser     string         `json:"sshUser"`
+	SSHRSAPath  string         `json:"sshRsaPath"`
+	PortRange   string         `json:"portRange"`
+	TokenFile   string         `json:"tokenFile"`
+	StateFile   string         `json:"stateFile"`
+	PinPorts    map[string]int `json:"pinPorts"`
+	SSHHostKeys []string       `json:"sshHostKeys"`
+	TLSCert     string         `json:"tlsCert"`
+	TLSKey      string         `json:"tlsKey"`
+	TLSClientCA string         `json:"tlsClientCA"`
+	// 内置 ssh 服务, 监听地址不为空时不再使用系统 sshd
+	SSHServerListen  string `json:"sshServerListen"`
+	SSHServerHostKey string `json:"sshServerHostKey"`
+	// 端口探测, probeInterval 为 0 时只靠控制连接心跳和 ssh 断开判断离线
+	ProbeInterval    int `json:"probeInterval"`
+	ProbeConcurrency int `json:"probeConcurrency"`
+	ProbeRate        int `json:"probeRate"`
+	// 同名客户端已经在线时的处理方式 reject, replace 或 suffix
+	DuplicateName string `json:"duplicateName"`
+	// 按需隧道没有连接超过 idleTimeout 秒后关闭, 默认 600
+	IdleTimeout int `json:"idleTimeout"`
+	// 管理接口的 bearer token, 为空时 /api/v1 关闭, 其他管理接口只接受本机请求
+	APITokens []string `json:"apiTokens"`
+	// 管理接口单独监听的地址, 如 127.0.0.1:10001, 为空时和控制连接共用 listenAddr
+	AdminListen string `json:"adminListen"`
+	// 管理接口 unix socket, 只有 stpsrv 运行用户和同组用户可以访问, 配置后 stpsrv -l 等命令优先使用
+	AdminSocket string `json:"adminSocket"`
+	// 按客户端名限速, 上行/下行每秒字节数, 如 {"yangbin": "128K/1M"}
+	RateLimits map[string]string `json:"rateLimits"`
 }
 
 var config = &GlobalConfig{}
@@ -23,12 +50,38 @@ func Config() *GlobalConfig {
 }
 
 func ParseConfig(file string) {
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		log.Fatalln("load config fail, error", err.Error())
+	}
+	config = cfg
+}
+
+// LoadConfig 读取配置文件, 重新加载配置时使用
+func LoadConfig(file string) (*GlobalConfig, error) {
+	cfg := &GlobalConfig{}
 	data, err := ioutil.ReadFile(file)
 	if err != nil && err != io.EOF {
-		log.Fatalln("load config fail, error", err.Error())
+		return nil, err
 	}
-	err = json.Unmarshal(data, config)
+	err = json.Unmarshal(data, cfg)
 	if err != nil {
-		log.Fatalln("load config fail, error", err.Error())
+		return nil, err
+	}
+	// 相对路径以配置文件所在目录为准
+	cfg.TokenFile = resolvePath(file, cfg.TokenFile)
+	cfg.StateFile = resolvePath(file, cfg.StateFile)
+	cfg.TLSCert = resolvePath(file, cfg.TLSCert)
+	cfg.TLSKey = resolvePath(file, cfg.TLSKey)
+	cfg.TLSClientCA = resolvePath(file, cfg.TLSClientCA)
+	cfg.SSHServerHostKey = resolvePath(file, cfg.SSHServerHostKey)
+	cfg.AdminSocket = resolvePath(file, cfg.AdminSocket)
+	return cfg, nil
+}
+
+func resolvePath(cfgFile, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(filepath.Dir(cfgFile), path)
 }
@@ -1,30 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/takama/daemon"
 	"github.com/yangbinnnn/stp"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	// VERSION 0.0.1
 	// 0.0.2 macos support
 	// 0.0.3 service supported
-	VERSION = "0.0.3"
+	// 0.0.4 protocol version negotiation
+	VERSION = "0.0.4"
 
 	name        = "stpsrv"
 	description = "stpsrv quickly create ssh tunnel service"
@@ -32,16 +39,62 @@ const (
 
 var service, _ = daemon.New(name, description)
 
-func listClients(serverAddr string) []*stp.Client {
-	u := url.URL{Scheme: "http", Host: serverAddr, Path: "/showClient"}
-	httpClient := http.Client{
-		Timeout: 3 * time.Second,
+// adminRequest 请求本机 stpsrv 的管理接口
+// 配置了 adminSocket 时通过 unix socket 访问, 不需要 token; 否则访问 adminListen 或控制端口, 配置了 apiTokens 时带上第一个 token
+func adminRequest(method, path string, query url.Values, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	u := &url.URL{Scheme: "http", Host: Config().ListentAddr, Path: path, RawQuery: query.Encode()}
+	httpClient := &http.Client{
+		Timeout: timeout,
 	}
-	resp, err := httpClient.Get(u.String())
+	useToken := true
+	if Config().AdminSocket != "" {
+		socket := Config().AdminSocket
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		u.Host = "stpsrv"
+		useToken = false
+	} else if Config().AdminListen != "" {
+		u.Host = Config().AdminListen
+	} else if Config().TLSCert != "" {
+		// 本机访问, 只校验是否为配置的证书
+		pin, err := stp.CertFilePin(Config().TLSCert)
+		if err != nil {
+			return nil, fmt.Errorf("load tls cert error %s", err.Error())
+		}
+		tlsConfig, _ := stp.NewClientTLSConfig("", "", "", pin)
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		u.Scheme = "https"
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if useToken && len(Config().APITokens) > 0 {
+		req.Header.Set("Authorization", "Bearer "+Config().APITokens[0])
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+func listClients() []*stp.Client {
+	resp, err := adminRequest(http.MethodGet, "/showClient", nil, nil, 3*time.Second)
 	if err != nil {
 		fmt.Println("http get error", err.Error())
 		return nil
 	}
+	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		fmt.Println("http read resp error", err.Error())
@@ -56,59 +109,391 @@ func listClients(serverAddr string) []*stp.Client {
 	return clients
 }
 
-func showClientCmd(serverAddr string) {
-	clients := listClients(serverAddr)
+func showClientCmd() {
+	clients := listClients()
 	if clients == nil {
 		fmt.Println("no client")
 		return
 	}
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"num", "name", "port", "addr", "online"})
-	for i, client := range clients {
-		table.Append([]string{strconv.Itoa(i), client.Name, client.Port, client.Addr, strconv.FormatBool(client.IsOnline)})
+	table.SetHeader([]string{"id", "name", "port", "forward", "addr", "online", "last seen", "traffic"})
+	for _, client := range clients {
+		lastSeen := ""
+		if client.LastSeen != 0 {
+			lastSeen = time.Unix(client.LastSeen, 0).Format("2006-01-02 15:04:05")
+		}
+		port := client.Port
+		if client.OnDemand && !client.Active {
+			port = "on demand"
+		}
+		forwards := []string{}
+		for _, target := range client.Targets {
+			if target.Addr == "" || target.Port == "" {
+				// old client forward port chosen by itself, or on demand tunnel not activated
+				continue
+			}
+			forwards = append(forwards, fmt.Sprintf("%s -> %s", target.Port, target))
+		}
+		table.Append([]string{client.ID, client.Name, port, strings.Join(forwards, "\n"), client.Addr, strconv.FormatBool(client.IsOnline), lastSeen, formatTraffic(client.Traffic)})
 	}
 	table.Render()
 }
 
-func connectClientCmd(num int, user string, serverAddr string) {
-	clients := listClients(serverAddr)
+// formatTraffic stpcli 启动以来的流量和进行中的连接
+func formatTraffic(traffic *stp.STPTraffic) string {
+	if traffic == nil {
+		return ""
+	}
+	lines := []string{fmt.Sprintf("in %s out %s", formatBytes(traffic.BytesIn), formatBytes(traffic.BytesOut))}
+	for _, tunnel := range traffic.Tunnels {
+		if tunnel.Active {
+			lines = append(lines, fmt.Sprintf("%s -> %s %s/%s %s", tunnel.Peer, tunnel.Target, formatBytes(tunnel.BytesIn), formatBytes(tunnel.BytesOut), time.Duration(tunnel.Duration)*time.Second))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
+
+// activateClient 打开按需客户端的隧道, 返回分配端口后的客户端
+func activateClient(key string) (*stp.Client, error) {
+	resp, err := adminRequest(http.MethodPost, "/activate", url.Values{"client": {key}}, nil, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("activate error %s", strings.TrimSpace(string(data)))
+	}
+	client := &stp.Client{}
+	err = json.NewDecoder(resp.Body).Decode(client)
+	return client, err
+}
+
+func activateClientCmd(key string) {
+	client, err := activateClient(key)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, target := range client.Targets {
+		fmt.Printf("%s -> %s\n", target.Port, target)
+	}
+}
+
+// apiAction 调用 /api/v1 的 POST 接口并打印结果
+func apiAction(path string) {
+	resp, err := adminRequest(http.MethodPost, "/api/v1/"+path, nil, nil, 30*time.Second)
+	if err != nil {
+		fmt.Println("http post error", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := stp.APIError{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fmt.Println(resp.Status, apiErr.Error)
+		return
+	}
+	result := stp.APIResult{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		fmt.Println("http read resp error", err.Error())
+		return
+	}
+	switch {
+	case result.Client != nil:
+		fmt.Println(result.Result, result.Client.Name, result.Client.ID)
+	case result.Port != nil:
+		fmt.Println(result.Result, result.Port.Port)
+	default:
+		fmt.Println(result.Result)
+	}
+}
+
+func kickClientCmd(key string) {
+	apiAction(fmt.Sprintf("clients/%s/kick", url.PathEscape(key)))
+}
+
+func releasePortCmd(port string) {
+	apiAction(fmt.Sprintf("ports/%s/release", url.PathEscape(port)))
+}
+
+func connectClientCmd(key string, user string) {
+	clients := listClients()
 	if clients == nil {
 		fmt.Println("no client")
 		return
 	}
-	client := clients[num]
+	client, err := stp.FindClient(clients, key)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if !client.IsOnline {
+		fmt.Println("client offline")
+		return
+	}
+	if client.OnDemand {
+		client, err = activateClient(client.ID)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
 	cmd := exec.Command("ssh", "-o", "ServerAliveInterval=30", "-o", "ServerAliveCountMax=3000", "-p", client.Port, fmt.Sprintf("%s@127.0.0.1", user))
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 }
 
-func loadSSHKey(path string) (private string, public string) {
-	privateByte, err := ioutil.ReadFile(path)
+// execCmd 在客户端执行命令, 输出到本地 stdout/stderr, 返回命令的退出码
+func execCmd(key string, args []string, timeout time.Duration) int {
+	if len(args) == 0 {
+		fmt.Println("need command, eg: stpsrv -x yangbin uptime")
+		return 2
+	}
+	query := url.Values{}
+	query.Set("client", key)
+	query.Set("timeout", strconv.Itoa(int(timeout/time.Second)))
+	resp, err := adminRequest(http.MethodPost, "/exec", query, strings.NewReader(strings.Join(args, " ")), 0)
 	if err != nil {
-		fmt.Println("load private key fail, error", err.Error())
-		os.Exit(1)
+		fmt.Println("http post error", err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		fmt.Println(resp.Status, strings.TrimSpace(string(data)))
+		return 1
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := stp.STPExecEvent{}
+		err := decoder.Decode(&event)
+		if err != nil {
+			fmt.Println("exec interrupted", err.Error())
+			return 1
+		}
+		switch {
+		case event.Error != "":
+			fmt.Fprintln(os.Stderr, event.Error)
+			return 1
+		case event.ExitCode != nil:
+			return *event.ExitCode
+		case event.Stream == "stderr":
+			os.Stderr.Write(event.Data)
+		default:
+			os.Stdout.Write(event.Data)
+		}
+	}
+}
+
+// fileCaller 通过本机 stpsrv 转发客户端文件命令
+func fileCaller(key string) stp.FileCaller {
+	return func(op string, req *stp.STPFileReq, resp *stp.STPFileResp) error {
+		query := url.Values{}
+		query.Set("client", key)
+		query.Set("op", op)
+		body, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		httpResp, err := adminRequest(http.MethodPost, "/file", query, bytes.NewReader(body), 0)
+		if err != nil {
+			return err
+		}
+		defer httpResp.Body.Close()
+		if httpResp.StatusCode != http.StatusOK {
+			data, _ := ioutil.ReadAll(httpResp.Body)
+			return fmt.Errorf("%s", strings.TrimSpace(string(data)))
+		}
+		return json.NewDecoder(httpResp.Body).Decode(resp)
+	}
+}
+
+// fileCmd stpsrv push <client> <local> <remote> 或 stpsrv pull <client> <remote> <local>
+func fileCmd(args []string) int {
+	if len(args) != 4 {
+		fmt.Println("usage: stpsrv push <client> <local> <remote>")
+		fmt.Println("       stpsrv pull <client> <remote> <local>")
+		return 2
+	}
+	call := fileCaller(args[1])
+	start := time.Now()
+	last := time.Time{}
+	progress := func(done, total int64) {
+		if time.Since(last) < time.Second && done != total {
+			return
+		}
+		last = time.Now()
+		fmt.Printf("\r%d/%d bytes", done, total)
+	}
+	var err error
+	if args[0] == "push" {
+		err = stp.PushFile(call, args[2], args[3], progress)
+	} else {
+		err = stp.PullFile(call, args[2], args[3], progress)
+	}
+	fmt.Println()
+	if err != nil {
+		fmt.Println(args[0], "error", err.Error())
+		return 1
 	}
+	fmt.Println(args[0], "done in", time.Since(start).Round(time.Millisecond))
+	return 0
+}
+
+func issueTokenCmd(tokenFile, name string, ttl time.Duration, portRange string) {
+	if tokenFile == "" {
+		fmt.Println("tokenFile not configured")
+		return
+	}
+	secret, err := stp.NewTokenStore(tokenFile).Issue(name, ttl, portRange)
+	if err != nil {
+		fmt.Println("issue token error", err.Error())
+		return
+	}
+	fmt.Println(secret)
+}
+
+func listTokenCmd(tokenFile string) {
+	if tokenFile == "" {
+		fmt.Println("tokenFile not configured")
+		return
+	}
+	tokens, err := stp.NewTokenStore(tokenFile).List()
+	if err != nil {
+		fmt.Println("list token error", err.Error())
+		return
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"name", "create", "expire", "ports"})
+	for _, token := range tokens {
+		expire := "never"
+		if token.ExpireAt != 0 {
+			expire = time.Unix(token.ExpireAt, 0).Format("2006-01-02 15:04:05")
+			if token.Expired() {
+				expire += " (expired)"
+			}
+		}
+		table.Append([]string{token.Name, time.Unix(token.CreateAt, 0).Format("2006-01-02 15:04:05"), expire, token.PortRange})
+	}
+	table.Render()
+}
+
+func revokeTokenCmd(tokenFile, name string) {
+	if tokenFile == "" {
+		fmt.Println("tokenFile not configured")
+		return
+	}
+	err := stp.NewTokenStore(tokenFile).Revoke(name)
+	if err != nil {
+		fmt.Println("revoke token error", err.Error())
+		return
+	}
+	fmt.Println("revoked", name)
+}
+
+func loadSSHPublicKey(path string, optional bool) string {
 	// plus ".pub"
 	publicByte, err := ioutil.ReadFile(path + ".pub")
 	if err != nil {
-		fmt.Println("load private key fail, error", err.Error())
+		fmt.Println("load public key fail, error", err.Error())
+		if optional {
+			return ""
+		}
 		os.Exit(1)
 	}
-	private = string(privateByte)
-	public = string(publicByte)
-	return
+	return string(publicByte)
+}
+
+// loadSSHHostKeys 读取 sshd host 公钥并计算指纹, 默认读取 /etc/ssh/ssh_host_*_key.pub
+func loadSSHHostKeys(paths []string) []string {
+	if len(paths) == 0 {
+		paths, _ = filepath.Glob("/etc/ssh/ssh_host_*_key.pub")
+	}
+	fingerprints := []string{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Println("load ssh host key fail, error", err.Error())
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			log.Println("parse ssh host key fail", path, err.Error())
+			continue
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+	if len(fingerprints) == 0 {
+		log.Println("no ssh host key loaded, clients will trust sshd on first use")
+	}
+	return fingerprints
+}
+
+// applyConfig 设置可以重新加载的配置
+// listenAddr, portRange, tls, ssh 等需要重启 stpsrv 才能生效
+func applyConfig(s *stp.STPServer, cfg *GlobalConfig) error {
+	limits := make(map[string]*stp.STPRateLimit)
+	for name, rate := range cfg.RateLimits {
+		limit, err := stp.ParseRateLimit(rate)
+		if err != nil {
+			return fmt.Errorf("rate limit of %s: %s", name, err.Error())
+		}
+		limits[name] = limit
+	}
+	policy := cfg.DuplicateName
+	if policy == "" {
+		policy = stp.DupNameReject
+	}
+	err := s.DupNamePolicy(policy)
+	if err != nil {
+		return err
+	}
+	s.PinPorts(cfg.PinPorts)
+	if cfg.IdleTimeout > 0 {
+		s.OnDemandIdleTimeout(time.Duration(cfg.IdleTimeout) * time.Second)
+	}
+	s.EnablePortProbe(time.Duration(cfg.ProbeInterval)*time.Second, cfg.ProbeConcurrency, cfg.ProbeRate)
+	s.UseAPITokens(cfg.APITokens)
+	s.RateLimits(limits)
+	return nil
 }
 
 func main() {
 	var (
 		showVersion bool
 		showClient  bool
-		connectNum  int
+		connectTo   string
+		activateOn  string
+		kickOn      string
+		releasePort string
 		connectUser string
+		execOn      string
+		execTimeout time.Duration
+		issueName   string
+		tokenTTL    time.Duration
+		tokenPorts  string
+		listToken   bool
+		revokeName  string
 
 		install    bool
 		uninstall  bool
@@ -126,8 +511,19 @@ func main() {
 	// CLI
 	flag.BoolVar(&showVersion, "v", false, "show version")
 	flag.BoolVar(&showClient, "l", false, "list clients")
-	flag.IntVar(&connectNum, "c", -1, "num connect to ssh client")
+	flag.StringVar(&connectTo, "c", "", "connect to ssh client by id or name")
 	flag.StringVar(&connectUser, "u", "root", "ssh connect user")
+	flag.StringVar(&activateOn, "activate", "", "open on demand tunnel of client by id or name")
+	flag.StringVar(&kickOn, "kick", "", "kick client by id or name, the client will not reconnect")
+	flag.StringVar(&releasePort, "release", "", "release port not used by online client")
+	flag.StringVar(&execOn, "x", "", "exec command on client by id or name, eg: stpsrv -x yangbin uptime")
+	flag.DurationVar(&execTimeout, "timeout", 60*time.Second, "exec command timeout")
+	// token
+	flag.StringVar(&issueName, "issue", "", "issue auth token for client name")
+	flag.DurationVar(&tokenTTL, "ttl", 0, "issued token ttl, 0 never expire")
+	flag.StringVar(&tokenPorts, "ports", "", "issued token allowed port range, eg 10001-10100")
+	flag.BoolVar(&listToken, "tokens", false, "list auth tokens")
+	flag.StringVar(&revokeName, "revoke", "", "revoke auth token of client name")
 	// service
 	flag.BoolVar(&install, "install", false, "install service")
 	flag.BoolVar(&uninstall, "uninstall", false, "uninstall service")
@@ -151,12 +547,50 @@ func main() {
 	ParseConfig(cfgFile)
 
 	if showClient {
-		showClientCmd(Config().ListentAddr)
+		showClientCmd()
+		return
+	}
+
+	if connectTo != "" {
+		connectClientCmd(connectTo, connectUser)
+		return
+	}
+
+	if activateOn != "" {
+		activateClientCmd(activateOn)
+		return
+	}
+
+	if kickOn != "" {
+		kickClientCmd(kickOn)
+		return
+	}
+
+	if releasePort != "" {
+		releasePortCmd(releasePort)
+		return
+	}
+
+	if execOn != "" {
+		os.Exit(execCmd(execOn, flag.Args(), execTimeout))
+	}
+
+	if flag.Arg(0) == "push" || flag.Arg(0) == "pull" {
+		os.Exit(fileCmd(flag.Args()))
+	}
+
+	if issueName != "" {
+		issueTokenCmd(Config().TokenFile, issueName, tokenTTL, tokenPorts)
 		return
 	}
 
-	if connectNum != -1 {
-		connectClientCmd(connectNum, connectUser, Config().ListentAddr)
+	if listToken {
+		listTokenCmd(Config().TokenFile)
+		return
+	}
+
+	if revokeName != "" {
+		revokeTokenCmd(Config().TokenFile, revokeName)
 		return
 	}
 
@@ -242,7 +676,55 @@ func main() {
 			}
 		}
 	}
-	privateKey, publicKey := loadSSHKey(Config().SSHRSAPath)
-	s := stp.NewSTPServer(Config().AuthKey, Config().ListentAddr, Config().SSHAddr, privateKey, publicKey, Config().SSHUser, Config().PortRange)
+	// 内置 ssh 服务不需要系统用户, 公钥只用于 -c 登录客户端
+	builtinSSH := Config().SSHServerListen != ""
+	publicKey := loadSSHPublicKey(Config().SSHRSAPath, builtinSSH)
+	s := stp.NewSTPServer(Config().AuthKey, Config().ListentAddr, Config().SSHAddr, publicKey, Config().SSHUser, Config().PortRange)
+	if Config().TokenFile != "" {
+		s.UseTokenStore(stp.NewTokenStore(Config().TokenFile))
+	}
+	if Config().StateFile != "" {
+		err = s.UseClientStore(stp.NewJSONClientStore(Config().StateFile))
+		if err != nil {
+			log.Fatalln("load client state error", err.Error())
+		}
+	}
+	err = applyConfig(s, Config())
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	s.OnReload(func() error {
+		cfg, err := LoadConfig(cfgFile)
+		if err != nil {
+			return err
+		}
+		return applyConfig(s, cfg)
+	})
+	if builtinSSH {
+		ss, err := stp.NewSSHServer(Config().SSHServerListen, Config().SSHServerHostKey, "127.0.0.1")
+		if err != nil {
+			log.Fatalln("load ssh server error", err.Error())
+		}
+		err = ss.Start()
+		if err != nil {
+			log.Fatalln("start ssh server error", err.Error())
+		}
+		s.UseSSHServer(ss)
+	} else {
+		s.AnnounceHostKeys(loadSSHHostKeys(Config().SSHHostKeys))
+	}
+	if Config().TLSCert != "" {
+		tlsConfig, err := stp.NewServerTLSConfig(Config().TLSCert, Config().TLSKey, Config().TLSClientCA)
+		if err != nil {
+			log.Fatalln("load tls config error", err.Error())
+		}
+		s.UseTLS(tlsConfig)
+	}
+	if Config().AdminListen != "" {
+		s.AdminListen(Config().AdminListen)
+	}
+	if Config().AdminSocket != "" {
+		s.AdminSocket(Config().AdminSocket)
+	}
 	s.Start()
 }
@@ -0,0 +1,109 @@
+package stp
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ControlConn websocket 控制连接
+// gorilla websocket 不支持并发写, 所有写操作加锁; text 消息为 json 命令, binary 消息为 WsMux 的 stream 帧
+type ControlConn struct {
+	*websocket.Conn
+	writeLock sync.Mutex
+	mux       *WsMux
+	keepAlive bool
+	onAlive   func()
+
+	// hello 协商结果, 在登录前设置
+	peerVersion  int
+	peerFeatures map[string]bool
+}
+
+const (
+	pingPeriod = 30 * time.Second
+	pongWait   = 75 * time.Second
+	writeWait  = 10 * time.Second
+)
+
+func NewControlConn(conn *websocket.Conn) *ControlConn {
+	return &ControlConn{Conn: conn}
+}
+
+func (c *ControlConn) WriteJSON(v interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+func (c *ControlConn) WriteMessage(messageType int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// ReadJSON 读取下一条 json 命令, 期间收到的 stream 帧交给 WsMux 处理
+func (c *ControlConn) ReadJSON(v interface{}) error {
+	for {
+		messageType, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if c.keepAlive {
+			c.extend()
+		}
+		if messageType == websocket.BinaryMessage {
+			if c.mux != nil {
+				c.mux.handleFrame(data)
+			}
+			continue
+		}
+		return json.Unmarshal(data, v)
+	}
+}
+
+// KeepAlive 设置读超时, 收到任何消息、ping 或 pong 都会延长, 对端失联 pongWait 后 ReadJSON 返回错误
+// onAlive 在每次延长时调用
+func (c *ControlConn) KeepAlive(onAlive func()) {
+	c.onAlive = onAlive
+	c.keepAlive = true
+	c.extend()
+	c.SetPongHandler(func(string) error {
+		c.extend()
+		return nil
+	})
+	c.SetPingHandler(func(data string) error {
+		c.extend()
+		// pong 写失败说明连接已经断开, 交给读超时处理
+		c.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		return nil
+	})
+}
+
+func (c *ControlConn) extend() {
+	c.SetReadDeadline(time.Now().Add(pongWait))
+	if c.onAlive != nil {
+		c.onAlive()
+	}
+}
+
+// Ping 每 pingPeriod 发送一次 ping, 连接断开后返回
+func (c *ControlConn) Ping() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *ControlConn) Close() error {
+	if c.mux != nil {
+		c.mux.Close()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,86 @@
+package stp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TunnelCredential 每次登录生成的临时 SSH 凭证
+// 私钥只下发给客户端，公钥由 TunnelAuthorizer 授权，
+// 只允许在分配的端口上做反向转发，不能登录 shell
+type TunnelCredential struct {
+	PrivateKey     string
+	PublicKey      ssh.PublicKey
+	Ports          []string
+	AuthorizedLine string
+	// Client 使用凭证的客户端名, 用于统计
+	Client string
+}
+
+// TunnelAuthorizer 授权临时凭证在分配的端口上做反向转发
+type TunnelAuthorizer interface {
+	Authorize(cred *TunnelCredential) error
+	Revoke(cred *TunnelCredential) error
+}
+
+// AuthorizedKeysAuthorizer 把临时公钥写入系统 sshd 用户的 authorized_keys
+type AuthorizedKeysAuthorizer struct {
+	User string
+}
+
+func (aa *AuthorizedKeysAuthorizer) Authorize(cred *TunnelCredential) error {
+	return AddAuthorizedKey(cred.AuthorizedLine, aa.User)
+}
+
+func (aa *AuthorizedKeysAuthorizer) Revoke(cred *TunnelCredential) error {
+	return RemoveAuthorizedKey(cred.AuthorizedLine, aa.User)
+}
+
+// Purge 删除上次运行留下的临时公钥, stpsrv 异常退出时没有收回
+func (aa *AuthorizedKeysAuthorizer) Purge() error {
+	return RemoveStaleKeys(aa.User)
+}
+
+// credentialTTL 临时公钥在 authorized_keys 中的有效期, 过期后 ssh 重连失败, 客户端重新登录换新的凭证
+const credentialTTL = 24 * time.Hour
+
+func NewTunnelCredential(ports []string) (*TunnelCredential, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	// restrict 关闭所有转发和 pty, 再单独打开端口转发并限制监听端口
+	options := "restrict,port-forwarding"
+	for _, port := range ports {
+		options += fmt.Sprintf(`,permitlisten="*:%s"`, port)
+	}
+	// expiry-time 需要 OpenSSH 7.7, 按 sshd 所在机器的本地时间
+	options += fmt.Sprintf(`,expiry-time="%s"`, time.Now().Add(credentialTTL).Format("200601021504"))
+	options += `,command="/bin/false"`
+	line := options + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))) + " stp-" + strings.Join(ports, "-")
+
+	return &TunnelCredential{
+		PrivateKey:     string(privateKey),
+		PublicKey:      publicKey,
+		Ports:          ports,
+		AuthorizedLine: line,
+	}, nil
+}
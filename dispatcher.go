@@ -0,0 +1,225 @@
+package stp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const callTimeout = 30 * time.Second
+
+// stpMessage 控制连接上的 json 消息, type 不为空是命令, 否则是响应
+// 命令的 data 是 base64 编码的 json, 响应的 data 是 json 对象
+type stpMessage struct {
+	ID      uint64          `json:"id"`
+	CmdType string          `json:"type"`
+	Status  int             `json:"status"`
+	ErrMsg  string          `json:"errMsg"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// RespError 对端返回的错误响应
+type RespError struct {
+	Status int
+	ErrMsg string
+}
+
+func (e *RespError) Error() string {
+	return fmt.Sprintf("Status: %d, ErrMsg: %s", e.Status, e.ErrMsg)
+}
+
+// CmdHandler 处理对端发来的命令, 成功时自己调用 Reply, 返回错误时回复 400
+type CmdHandler func(cmd *STPCmd) error
+
+// Dispatcher 控制连接上的请求响应匹配
+// Call 发送带 id 的命令并等待同 id 的响应, 对端发来的命令交给 Handle 注册的处理函数
+// 处理函数在读循环中依次执行, 不能在处理函数里调用 Call
+type Dispatcher struct {
+	conn     *ControlConn
+	handlers map[string]CmdHandler
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *stpMessage
+	order   []uint64 // 旧版本的响应没有 id, 按发送顺序匹配
+	err     error
+}
+
+func NewDispatcher(conn *ControlConn) *Dispatcher {
+	return &Dispatcher{
+		conn:     conn,
+		handlers: make(map[string]CmdHandler),
+		pending:  make(map[uint64]chan *stpMessage),
+	}
+}
+
+// Handle 注册命令处理函数, 需要在 Run 之前调用
+func (d *Dispatcher) Handle(cmdType string, handler CmdHandler) {
+	d.handlers[cmdType] = handler
+}
+
+// Send 发送不需要响应的命令
+func (d *Dispatcher) Send(cmdType string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return d.conn.WriteJSON(STPCmd{CmdType: cmdType, Data: raw})
+}
+
+// Call 发送命令并等待响应, 响应数据解析到 resp
+func (d *Dispatcher) Call(cmdType string, data interface{}, resp interface{}) error {
+	return d.CallTimeout(cmdType, data, resp, callTimeout)
+}
+
+// CallTimeout 同 Call, 用于执行时间较长的命令
+func (d *Dispatcher) CallTimeout(cmdType string, data interface{}, resp interface{}, timeout time.Duration) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *stpMessage, 1)
+	d.lock.Lock()
+	if d.err != nil {
+		d.lock.Unlock()
+		return d.err
+	}
+	d.nextID++
+	id := d.nextID
+	d.pending[id] = ch
+	d.order = append(d.order, id)
+	d.lock.Unlock()
+	defer d.remove(id)
+
+	err = d.conn.WriteJSON(STPCmd{ID: id, CmdType: cmdType, Data: raw})
+	if err != nil {
+		return err
+	}
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return d.closedErr()
+		}
+		if msg.Status != 200 {
+			return &RespError{Status: msg.Status, ErrMsg: msg.ErrMsg}
+		}
+		if resp == nil || len(msg.Data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(msg.Data, resp)
+	case <-time.After(timeout):
+		return fmt.Errorf("%s timeout", cmdType)
+	}
+}
+
+// Reply 回复命令, data 为 nil 时只返回状态
+func (d *Dispatcher) Reply(cmd *STPCmd, data interface{}) error {
+	resp := STPResp{ID: cmd.ID, Status: 200}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		resp.Data = raw
+	}
+	return d.conn.WriteJSON(resp)
+}
+
+func (d *Dispatcher) replyError(cmd *STPCmd, msg string) error {
+	resp := NewBadRequestError(msg)
+	resp.ID = cmd.ID
+	return d.conn.WriteJSON(resp)
+}
+
+func (d *Dispatcher) remove(id uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.removeLocked(id)
+}
+
+func (d *Dispatcher) removeLocked(id uint64) {
+	delete(d.pending, id)
+	for idx, pending := range d.order {
+		if pending == id {
+			d.order = append(d.order[:idx], d.order[idx+1:]...)
+			break
+		}
+	}
+}
+
+func (d *Dispatcher) closedErr() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.err
+}
+
+// Run 读取消息直到连接断开, 返回读错误, 等待中的 Call 同时返回
+func (d *Dispatcher) Run() error {
+	for {
+		msg := &stpMessage{}
+		err := d.conn.ReadJSON(msg)
+		if err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				log.Println("invalid message", err.Error())
+				continue
+			}
+			d.close(err)
+			return err
+		}
+		if msg.CmdType == "" {
+			d.route(msg)
+			continue
+		}
+		cmd := &STPCmd{ID: msg.ID, CmdType: msg.CmdType}
+		if len(msg.Data) > 0 {
+			err = json.Unmarshal(msg.Data, &cmd.Data)
+			if err != nil {
+				d.replyError(cmd, "invalid cmd data")
+				continue
+			}
+		}
+		handler, ok := d.handlers[cmd.CmdType]
+		if !ok {
+			d.replyError(cmd, "Unknow CMD")
+			continue
+		}
+		err = handler(cmd)
+		if err != nil {
+			log.Println("on", cmd.CmdType, "error:", err.Error())
+			d.replyError(cmd, err.Error())
+		}
+	}
+}
+
+func (d *Dispatcher) route(msg *stpMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	id := msg.ID
+	if id == 0 && len(d.order) > 0 {
+		id = d.order[0]
+	}
+	ch, ok := d.pending[id]
+	if !ok {
+		log.Println("drop response", msg.ID, msg.Status, msg.ErrMsg)
+		return
+	}
+	d.removeLocked(id)
+	ch <- msg
+}
+
+func (d *Dispatcher) close(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return
+	}
+	d.err = errors.New("control connection closed: " + err.Error())
+	for id, ch := range d.pending {
+		close(ch)
+		delete(d.pending, id)
+	}
+}
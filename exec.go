@@ -0,0 +1,332 @@
+package stp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExecTimeout = 60 * time.Second
+	maxExecTimeout     = time.Hour
+	execChunkSize      = 4096
+	// 命令退出后等待输出的时间, 后台子进程一直占用输出时不再等待
+	execWaitDelay = 5 * time.Second
+	// 服务端缓存的输出块数, 读取方跟不上时中止 exec
+	execOutputBuffer = 256
+)
+
+// STPExecReq 服务端请求客户端执行命令, 命令按空格分割直接执行, 不经过 shell
+type STPExecReq struct {
+	ExecID  string `json:"execId"`
+	Command string `json:"command"`
+	Timeout int    `json:"timeout"` // 秒
+}
+
+// STPExecOutput 命令执行过程中客户端发送的输出, stream 为 stdout 或 stderr
+type STPExecOutput struct {
+	ExecID string `json:"execId"`
+	Stream string `json:"stream"`
+	Data   []byte `json:"data"`
+}
+
+// STPExecResp exec 响应, 所有输出发送完后返回
+type STPExecResp struct {
+	ExitCode int `json:"exitCode"`
+}
+
+// LoadExecAllowlist 读取允许执行的命令, 每行一条, # 开头为注释
+// "uptime" 允许 uptime 和 uptime -p, "systemctl status" 允许 systemctl status sshd
+func LoadExecAllowlist(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	allow := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		allow = append(allow, line)
+	}
+	return allow, scanner.Err()
+}
+
+// execAllowed 命令的前几个参数和某条规则完全相同时允许执行
+func execAllowed(allow []string, args []string) bool {
+	for _, rule := range allow {
+		words := strings.Fields(rule)
+		if len(words) == 0 || len(words) > len(args) {
+			continue
+		}
+		matched := true
+		for i, word := range words {
+			if args[i] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowExec 设置允许服务端执行的命令, 为空时拒绝所有 exec
+func (s *STPClient) AllowExec(allow []string) {
+	s.execAllow = allow
+}
+
+// onExec 客户端处理 exec, 命令在后台执行, 读循环继续处理其他消息
+func (s *STPClient) onExec(disp *Dispatcher, cmd *STPCmd) error {
+	req := STPExecReq{}
+	err := json.Unmarshal(cmd.Data, &req)
+	if err != nil {
+		return err
+	}
+	args := strings.Fields(req.Command)
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+	if len(s.execAllow) == 0 {
+		return errors.New("exec disabled on client")
+	}
+	if !execAllowed(s.execAllow, args) {
+		log.Println("exec not allowed:", req.Command)
+		return fmt.Errorf("command not allowed: %s", args[0])
+	}
+	timeout := execTimeout(time.Duration(req.Timeout) * time.Second)
+	log.Println("exec:", req.Command)
+	go func() {
+		exitCode, err := runCommand(args, timeout, func(stream string, data []byte) {
+			disp.Send("execOutput", &STPExecOutput{ExecID: req.ExecID, Stream: stream, Data: data})
+		})
+		if err != nil {
+			log.Println("exec error:", req.Command, err.Error())
+			disp.replyError(cmd, err.Error())
+			return
+		}
+		disp.Reply(cmd, &STPExecResp{ExitCode: exitCode})
+	}()
+	return nil
+}
+
+// runCommand 执行命令并按块返回输出, 超时后结束进程
+// 命令退出或超时后最多再等 execWaitDelay, 后台子进程继承的输出不再读取
+func runCommand(args []string, timeout time.Duration, output func(stream string, data []byte)) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	command := exec.CommandContext(ctx, args[0], args[1:]...)
+	command.Stdout = &outputWriter{stream: "stdout", output: output}
+	command.Stderr = &outputWriter{stream: "stderr", output: output}
+	command.WaitDelay = execWaitDelay
+	err := command.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, fmt.Errorf("command timeout after %s", timeout)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		log.Println("exec output still open after exit, ignored:", args[0])
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// outputWriter 把命令输出按 execChunkSize 分块交给 output
+type outputWriter struct {
+	stream string
+	output func(stream string, data []byte)
+}
+
+func (ow *outputWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := len(p)
+		if n > execChunkSize {
+			n = execChunkSize
+		}
+		ow.output(ow.stream, append([]byte{}, p[:n]...))
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// execSession 服务端等待输出的 exec
+// 读循环只把输出放入 outputs, 由调用 Exec 的协程交给 output, 缓存满时中止
+type execSession struct {
+	client   *Client
+	lock     sync.Mutex
+	closed   bool
+	outputs  chan *STPExecOutput
+	overflow chan bool
+}
+
+// push 在读循环中调用, 不会阻塞
+func (es *execSession) push(out *STPExecOutput) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	if es.closed {
+		return
+	}
+	select {
+	case es.outputs <- out:
+	default:
+		es.closed = true
+		close(es.overflow)
+	}
+}
+
+func (es *execSession) close() {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	es.closed = true
+}
+
+// execTimeout 没有设置时使用默认超时, 超过 maxExecTimeout 时使用 maxExecTimeout
+func execTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultExecTimeout
+	}
+	if timeout > maxExecTimeout {
+		return maxExecTimeout
+	}
+	return timeout
+}
+
+// Exec 在 id 或名字为 key 的在线客户端上执行命令, 输出在当前协程通过 output 返回, 返回退出码
+// output 太慢导致输出积压或 ctx 取消时不再等待, 返回错误
+func (s *STPServer) Exec(ctx context.Context, key, command string, timeout time.Duration, output func(stream string, data []byte)) (int, error) {
+	client, err := FindClient(s.cliMgr.Sessions(), key)
+	if err != nil {
+		return -1, fmt.Errorf("%s, or offline", err.Error())
+	}
+	if !client.conn.Supports(FeatureExec) {
+		return -1, fmt.Errorf("client %s does not support exec", client.Name)
+	}
+	timeout = execTimeout(timeout)
+	execID := newClientID()
+	session := &execSession{
+		client:   client,
+		outputs:  make(chan *STPExecOutput, execOutputBuffer),
+		overflow: make(chan bool),
+	}
+	s.execLock.Lock()
+	s.execs[execID] = session
+	s.execLock.Unlock()
+	defer func() {
+		s.execLock.Lock()
+		delete(s.execs, execID)
+		s.execLock.Unlock()
+		session.close()
+	}()
+	log.Println("exec on", client.Name, ":", command)
+	resp := &STPExecResp{}
+	req := &STPExecReq{ExecID: execID, Command: command, Timeout: int(timeout / time.Second)}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.disp.CallTimeout("exec", req, resp, timeout+callTimeout)
+	}()
+	for {
+		select {
+		case out := <-session.outputs:
+			output(out.Stream, out.Data)
+		case <-ctx.Done():
+			log.Println("exec canceled on", client.Name, ":", command)
+			return -1, ctx.Err()
+		case <-session.overflow:
+			log.Println("exec output overflow on", client.Name, ":", command)
+			return -1, errors.New("exec aborted, output not consumed fast enough")
+		case err = <-done:
+			// 客户端发送完所有输出后才响应, 输出已经在 outputs 中
+			session.close()
+			select {
+			case <-session.overflow:
+				log.Println("exec output overflow on", client.Name, ":", command)
+				return -1, errors.New("exec aborted, output not consumed fast enough")
+			default:
+			}
+			for len(session.outputs) > 0 {
+				out := <-session.outputs
+				output(out.Stream, out.Data)
+			}
+			if err != nil {
+				return -1, err
+			}
+			return resp.ExitCode, nil
+		}
+	}
+}
+
+// onExecOutput 服务端把客户端的输出交给对应的 exec, 在读循环中执行, 不能阻塞
+func (s *STPServer) onExecOutput(d *Dispatcher, cmd *STPCmd) error {
+	out := STPExecOutput{}
+	err := json.Unmarshal(cmd.Data, &out)
+	if err != nil {
+		return err
+	}
+	s.execLock.Lock()
+	session, ok := s.execs[out.ExecID]
+	s.execLock.Unlock()
+	if !ok || session.client.disp != d {
+		return nil
+	}
+	session.push(&out)
+	return nil
+}
+
+// STPExecEvent /exec 返回的一行 json, 输出为 stream 和 data, 最后一行为 exitCode 或 error
+type STPExecEvent struct {
+	Stream   string `json:"stream,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ExecHandler POST /exec?client=<id|name>&timeout=<秒>, body 为命令
+func (s *STPServer) ExecHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, _ := strconv.Atoi(r.URL.Query().Get("timeout"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	exitCode, err := s.Exec(r.Context(), r.URL.Query().Get("client"), string(body), time.Duration(timeout)*time.Second, func(stream string, data []byte) {
+		encoder.Encode(&STPExecEvent{Stream: stream, Data: data})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil {
+		encoder.Encode(&STPExecEvent{Error: err.Error()})
+		return
+	}
+	encoder.Encode(&STPExecEvent{ExitCode: &exitCode})
+}
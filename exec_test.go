@@ -0,0 +1,21 @@
+package stp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExecTimeout(t *testing.T) {
+	cases := map[time.Duration]time.Duration{
+		0:                defaultExecTimeout,
+		-time.Second:     defaultExecTimeout,
+		30 * time.Second: 30 * time.Second,
+		maxExecTimeout:   maxExecTimeout,
+		2 * time.Hour:    maxExecTimeout,
+	}
+	for timeout, expected := range cases {
+		if got := execTimeout(timeout); got != expected {
+			t.Fatalf("execTimeout(%s) = %s, expected %s", timeout, got, expected)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package stp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	fileChunkSize = 256 * 1024
+	// 未传完的文件, 用于断点续传
+	partSuffix = ".stppart"
+)
+
+// 文件命令, 服务端发给客户端
+const (
+	FileStat   = "fileStat"
+	FileRead   = "fileRead"
+	FileWrite  = "fileWrite"
+	FileCommit = "fileCommit"
+)
+
+// STPFileReq 文件命令参数, path 为客户端 root 下的相对路径
+type STPFileReq struct {
+	Path   string `json:"path"`
+	Part   bool   `json:"part,omitempty"`   // fileStat 查询未传完的文件
+	Offset int64  `json:"offset,omitempty"` // fileRead, fileWrite
+	Length int64  `json:"length,omitempty"` // fileRead 读取长度, fileStat 只计算前 length 字节的 sum
+	Data   []byte `json:"data,omitempty"`   // fileWrite
+	Sum    string `json:"sum,omitempty"`    // fileWrite 为 data 的 sha256, fileCommit 为整个文件的 sha256
+	Size   int64  `json:"size,omitempty"`   // fileCommit
+}
+
+// STPFileResp 文件命令响应
+type STPFileResp struct {
+	Exists bool   `json:"exists"`
+	Size   int64  `json:"size"`
+	Sum    string `json:"sum"`
+	Data   []byte `json:"data,omitempty"`
+	EOF    bool   `json:"eof,omitempty"`
+}
+
+// FileCaller 调用客户端的文件命令
+type FileCaller func(op string, req *STPFileReq, resp *STPFileResp) error
+
+func sumBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sumFile 计算文件前 length 字节的 sha256, length 小于等于 0 时计算整个文件
+func sumFile(path string, length int64) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if length > 0 {
+		r = io.LimitReader(file, length)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// PushFile 把本地文件上传到客户端 remote, 客户端已有未传完的同一文件时从断点继续
+func PushFile(call FileCaller, local, remote string, progress func(done, total int64)) error {
+	total, err := fileSize(local)
+	if err != nil {
+		return err
+	}
+	offset := int64(0)
+	part := &STPFileResp{}
+	err = call(FileStat, &STPFileReq{Path: remote, Part: true}, part)
+	if err != nil {
+		return err
+	}
+	if part.Exists && part.Size > 0 && part.Size <= total {
+		sum, _, err := sumFile(local, part.Size)
+		if err == nil && sum == part.Sum {
+			offset = part.Size
+			log.Println("resume push from", offset)
+		}
+	}
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, fileChunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 || offset == 0 {
+			data := buf[:n]
+			resp := &STPFileResp{}
+			err := call(FileWrite, &STPFileReq{Path: remote, Offset: offset, Data: data, Sum: sumBytes(data)}, resp)
+			if err != nil {
+				return err
+			}
+			offset += int64(n)
+			if progress != nil {
+				progress(offset, total)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sum, size, err := sumFile(local, 0)
+	if err != nil {
+		return err
+	}
+	return call(FileCommit, &STPFileReq{Path: remote, Size: size, Sum: sum}, &STPFileResp{})
+}
+
+// PullFile 把客户端文件 remote 下载到本地, 本地有未传完的同一文件时从断点继续
+func PullFile(call FileCaller, remote, local string, progress func(done, total int64)) error {
+	stat := &STPFileResp{}
+	err := call(FileStat, &STPFileReq{Path: remote}, stat)
+	if err != nil {
+		return err
+	}
+	if !stat.Exists {
+		return fmt.Errorf("%s not exists", remote)
+	}
+	partPath := local + partSuffix
+	offset := int64(0)
+	if partSize, err := fileSize(partPath); err == nil && partSize > 0 && partSize <= stat.Size {
+		prefix := &STPFileResp{}
+		err = call(FileStat, &STPFileReq{Path: remote, Length: partSize}, prefix)
+		if err != nil {
+			return err
+		}
+		sum, _, err := sumFile(partPath, 0)
+		if err == nil && sum == prefix.Sum {
+			offset = partSize
+			log.Println("resume pull from", offset)
+		}
+	}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	for offset < stat.Size {
+		resp := &STPFileResp{}
+		err = call(FileRead, &STPFileReq{Path: remote, Offset: offset, Length: fileChunkSize}, resp)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if sumBytes(resp.Data) != resp.Sum {
+			file.Close()
+			return errors.New("chunk checksum mismatch")
+		}
+		_, err = file.Write(resp.Data)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		offset += int64(len(resp.Data))
+		if progress != nil {
+			progress(offset, stat.Size)
+		}
+		if resp.EOF || len(resp.Data) == 0 {
+			break
+		}
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	sum, size, err := sumFile(partPath, 0)
+	if err != nil {
+		return err
+	}
+	if size != stat.Size || sum != stat.Sum {
+		// 传输过程中文件有变化, 下次重新下载
+		os.Remove(partPath)
+		return errors.New("file checksum mismatch, remote file changed during pull")
+	}
+	return os.Rename(partPath, local)
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return 0, fmt.Errorf("%s is a directory", path)
+	}
+	return info.Size(), nil
+}
+
+// UseFileRoot 允许服务端读写 root 目录下的文件, 为空时拒绝文件传输
+func (s *STPClient) UseFileRoot(root string) {
+	s.fileRoot = root
+}
+
+// realPath 解析 path 中已经存在部分的符号链接, 还不存在的部分原样拼接, 中间有失效的符号链接时返回错误
+func realPath(path string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(path); lerr == nil {
+			return "", fmt.Errorf("%s is a broken symlink", path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// filePath 把服务端传来的路径限制在 fileRoot 下, 符号链接也不能指向 fileRoot 之外
+// 文件和 .stppart 还不存在时检查最近的已存在的上级目录
+func (s *STPClient) filePath(path string) (string, error) {
+	if s.fileRoot == "" {
+		return "", errors.New("file transfer disabled on client")
+	}
+	root, err := filepath.EvalSymlinks(s.fileRoot)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(root, filepath.Clean("/"+path))
+	for _, p := range []string{full, full + partSuffix} {
+		if p == root+partSuffix {
+			continue
+		}
+		real, err := realPath(p)
+		if err != nil {
+			return "", err
+		}
+		if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s is outside of root", path)
+		}
+	}
+	return full, nil
+}
+
+// onFile 客户端处理文件命令, 在后台执行避免大文件计算 sum 时阻塞读循环
+func (s *STPClient) onFile(disp *Dispatcher, cmd *STPCmd) error {
+	req := &STPFileReq{}
+	err := json.Unmarshal(cmd.Data, req)
+	if err != nil {
+		return err
+	}
+	path, err := s.filePath(req.Path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		resp, err := handleFileCmd(cmd.CmdType, path, req)
+		if err != nil {
+			log.Println(cmd.CmdType, req.Path, "error:", err.Error())
+			disp.replyError(cmd, err.Error())
+			return
+		}
+		disp.Reply(cmd, resp)
+	}()
+	return nil
+}
+
+func handleFileCmd(op, path string, req *STPFileReq) (*STPFileResp, error) {
+	resp := &STPFileResp{}
+	switch op {
+	case FileStat:
+		if req.Part {
+			path += partSuffix
+		}
+		if _, err := fileSize(path); err != nil {
+			if os.IsNotExist(err) {
+				return resp, nil
+			}
+			return nil, err
+		}
+		sum, size, err := sumFile(path, req.Length)
+		if err != nil {
+			return nil, err
+		}
+		resp.Exists, resp.Size, resp.Sum = true, size, sum
+	case FileRead:
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		length := req.Length
+		if length <= 0 || length > fileChunkSize {
+			length = fileChunkSize
+		}
+		buf := make([]byte, length)
+		n, err := file.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		resp.Data, resp.Sum, resp.EOF = buf[:n], sumBytes(buf[:n]), err == io.EOF
+	case FileWrite:
+		if sumBytes(req.Data) != req.Sum {
+			return nil, errors.New("chunk checksum mismatch")
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, err
+		}
+		flag := os.O_CREATE | os.O_WRONLY
+		if req.Offset == 0 {
+			flag |= os.O_TRUNC
+		}
+		file, err := openPartFile(path+partSuffix, flag)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != req.Offset {
+			return nil, fmt.Errorf("offset %d mismatch, part size %d", req.Offset, info.Size())
+		}
+		_, err = file.WriteAt(req.Data, req.Offset)
+		if err != nil {
+			return nil, err
+		}
+		resp.Size = req.Offset + int64(len(req.Data))
+	case FileCommit:
+		sum, size, err := sumFile(path+partSuffix, 0)
+		if err != nil {
+			return nil, err
+		}
+		if size != req.Size || sum != req.Sum {
+			os.Remove(path + partSuffix)
+			return nil, errors.New("file checksum mismatch")
+		}
+		err = os.Rename(path+partSuffix, path)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("file received", path, size)
+		resp.Exists, resp.Size, resp.Sum = true, size, sum
+	default:
+		return nil, fmt.Errorf("unknown file cmd %s", op)
+	}
+	return resp, nil
+}
+
+// FileCall 调用 id 或名字为 key 的在线客户端的文件命令
+func (s *STPServer) FileCall(key, op string, req *STPFileReq, resp *STPFileResp) error {
+	client, err := FindClient(s.cliMgr.Sessions(), key)
+	if err != nil {
+		return fmt.Errorf("%s, or offline", err.Error())
+	}
+	if !client.conn.Supports(FeatureFile) {
+		return fmt.Errorf("client %s does not support file transfer", client.Name)
+	}
+	switch op {
+	case FileStat, FileRead, FileWrite, FileCommit:
+	default:
+		return fmt.Errorf("unknown file cmd %s", op)
+	}
+	// 计算大文件的 sum 需要时间
+	return client.disp.CallTimeout(op, req, resp, 10*time.Minute)
+}
+
+// FileHandler POST /file?client=<id|name>&op=<fileStat|fileRead|fileWrite|fileCommit>, body 为 STPFileReq
+// 转发给客户端, 返回 STPFileResp, stpsrv push/pull 使用
+func (s *STPServer) FileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &STPFileReq{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 2*fileChunkSize)).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := &STPFileResp{}
+	err = s.FileCall(r.URL.Query().Get("client"), r.URL.Query().Get("op"), req, resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
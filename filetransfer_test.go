@@ -0,0 +1,77 @@
+package stp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePathSymlink(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside, filepath.Join(root, "sub")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"out":           outside,
+		"sub/up":        "../..",
+		"f.txt.stppart": filepath.Join(outside, "missing"),
+		"dangling":      filepath.Join(outside, "missing"),
+		"inside":        "sub",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli := &STPClient{}
+	cli.UseFileRoot(root)
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[string]string{
+		"a.txt":            "a.txt",
+		"new/dir/b.txt":    "new/dir/b.txt",
+		"../../etc/passwd": "etc/passwd",
+		"inside/c.txt":     "inside/c.txt",
+		"":                 "",
+	}
+	for path, expected := range allowed {
+		full, err := cli.filePath(path)
+		if err != nil {
+			t.Fatalf("%q: %v", path, err)
+		}
+		if full != filepath.Join(real, expected) {
+			t.Fatalf("%q: got %s", path, full)
+		}
+	}
+	// 目标还不存在时也要检查上级目录的符号链接和 .stppart
+	for _, path := range []string{"out/x.txt", "out/new/dir/x.txt", "sub/up/outside/x.txt", "f.txt", "dangling", "dangling/x"} {
+		if full, err := cli.filePath(path); err == nil {
+			t.Fatalf("%q: expected error, got %s", path, full)
+		}
+	}
+}
+
+func TestFileWritePartNoFollow(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	path := filepath.Join(dir, "f.txt")
+	if err := os.Symlink(target, path+partSuffix); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello")
+	_, err := handleFileCmd(FileWrite, path, &STPFileReq{Data: data, Sum: sumBytes(data)})
+	if err == nil {
+		t.Fatal("expected error writing through symlinked part file")
+	}
+	if _, err := ioutil.ReadFile(target); !os.IsNotExist(err) {
+		t.Fatalf("symlink target written: %v", err)
+	}
+}
@@ -5,19 +5,25 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	osuser "os/user"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 )
 
-func AddAuthorizedKey(publicKey, user string) error {
+// authorized_keys 可能被多个登录同时修改
+var authorizedKeysLock sync.Mutex
+
+func authorizedKeysPath(user string) (string, error) {
 	authPath := "/root/.ssh/authorized_keys"
 	if user == "" {
 		u, err := osuser.Current()
 		if err != nil {
-			return err
+			return "", err
 		}
 		user = u.Username
 	}
@@ -28,8 +34,26 @@ func AddAuthorizedKey(publicKey, user string) error {
 			authPath = fmt.Sprintf("/home/%s/.ssh/authorized_keys", user)
 		}
 	}
+	return authPath, nil
+}
+
+// DefaultKnownHostsPath stpcli 记录 sshd host key 指纹的文件
+func DefaultKnownHostsPath() string {
+	authPath, err := authorizedKeysPath("")
+	if err != nil {
+		return "stp_known_hosts"
+	}
+	return filepath.Join(filepath.Dir(authPath), "stp_known_hosts")
+}
+
+func AddAuthorizedKey(publicKey, user string) error {
+	authorizedKeysLock.Lock()
+	defer authorizedKeysLock.Unlock()
+	authPath, err := authorizedKeysPath(user)
+	if err != nil {
+		return err
+	}
 	var file *os.File
-	var err error
 	if !FileExist(authPath) {
 		file, err = os.Create(authPath)
 		if err != nil {
@@ -73,6 +97,71 @@ func AddAuthorizedKey(publicKey, user string) error {
 	return rw.Flush()
 }
 
+// RemoveAuthorizedKey 从 authorized_keys 中删除指定的 key
+func RemoveAuthorizedKey(publicKey, user string) error {
+	authorizedKeysLock.Lock()
+	defer authorizedKeysLock.Unlock()
+	authPath, err := authorizedKeysPath(user)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(authPath)
+	if err != nil {
+		return err
+	}
+	publicKey = strings.TrimSpace(publicKey)
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.TrimSpace(line) == publicKey {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return ioutil.WriteFile(authPath, []byte(content), 0600)
+}
+
+// RemoveStaleKeys 删除 authorized_keys 中 stpsrv 签发的临时公钥, 注释为 stp-<端口>
+func RemoveStaleKeys(user string) error {
+	authorizedKeysLock.Lock()
+	defer authorizedKeysLock.Unlock()
+	authPath, err := authorizedKeysPath(user)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(authPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	removed := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "stp-") && strings.Contains(line, "permitlisten=") {
+			removed++
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if removed == 0 {
+		return nil
+	}
+	log.Println("remove", removed, "stale tunnel keys from", authPath)
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return ioutil.WriteFile(authPath, []byte(content), 0600)
+}
+
 func FileExist(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil || os.IsExist(err)
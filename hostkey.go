@@ -0,0 +1,109 @@
+package stp
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyPinner 校验服务端 sshd 的 host key
+// 优先使用指定的指纹, 否则使用 known hosts 文件中记录的指纹, 首次连接时记录下来
+type HostKeyPinner struct {
+	path        string
+	fingerprint string
+	lock        sync.Mutex
+}
+
+func NewHostKeyPinner(path, fingerprint string) *HostKeyPinner {
+	return &HostKeyPinner{path: path, fingerprint: fingerprint}
+}
+
+// Callback 返回 ssh 连接 addr 时使用的 HostKeyCallback, offered 为 stpsrv 登录时下发的指纹
+func (hp *HostKeyPinner) Callback(addr string, offered []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hp.lock.Lock()
+		defer hp.lock.Unlock()
+		got := ssh.FingerprintSHA256(key)
+		if hp.fingerprint != "" {
+			if got != hp.fingerprint {
+				return fmt.Errorf("ssh host key mismatch for %s: got %s, expected %s from -hostkey flag", addr, got, hp.fingerprint)
+			}
+			return nil
+		}
+
+		known, err := hp.load(addr)
+		if err != nil {
+			return err
+		}
+		if len(known) != 0 {
+			for _, fp := range known {
+				if got == fp {
+					return nil
+				}
+			}
+			return fmt.Errorf("ssh host key mismatch for %s: got %s, expected %s. "+
+				"if the server key was changed on purpose, remove the line from %s",
+				addr, got, strings.Join(known, ","), hp.path)
+		}
+
+		// first use
+		if len(offered) != 0 && !containsString(offered, got) {
+			return fmt.Errorf("ssh host key of %s is %s, not one of the server announced %s", addr, got, strings.Join(offered, ","))
+		}
+		if len(offered) == 0 {
+			log.Println("server did not announce ssh host key, trust", got, "on first use")
+		}
+		return hp.save(addr, got)
+	}
+}
+
+func (hp *HostKeyPinner) load(addr string) ([]string, error) {
+	known := []string{}
+	file, err := os.Open(hp.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return known, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == addr {
+			known = append(known, fields[1])
+		}
+	}
+	return known, scanner.Err()
+}
+
+func (hp *HostKeyPinner) save(addr, fingerprint string) error {
+	file, err := os.OpenFile(hp.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", addr, fingerprint)
+	if err == nil {
+		log.Println("pin ssh host key", addr, fingerprint, "to", hp.path)
+	}
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
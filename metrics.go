@@ -0,0 +1,237 @@
+package stp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 登录失败原因, 作为 stp_login_failures_total 的 reason 标签
+const (
+	loginFailBadRequest = "bad_request"
+	loginFailName       = "invalid_name"
+	loginFailAuth       = "auth"
+	loginFailDupName    = "duplicate_name"
+	loginFailTargets    = "targets"
+	loginFailTransport  = "transport"
+	loginFailTunnel     = "tunnel"
+	loginFailReply      = "reply"
+)
+
+var loginFailReasons = []string{loginFailBadRequest, loginFailName, loginFailAuth, loginFailDupName, loginFailTargets, loginFailTransport, loginFailTunnel, loginFailReply}
+
+// serverMetrics stpsrv 的计数, /metrics 按 prometheus 文本格式输出
+// 在线客户端和端口池在输出时从 ClientManager 和 PortManager 读取
+type serverMetrics struct {
+	lock          sync.Mutex
+	connected     int
+	loginSuccess  int64
+	loginFailures map[string]int64
+	portFailures  int64
+	relogins      int64
+	sweeps        int64
+	sweepSeconds  float64
+	lastSweep     float64
+	bytes         map[string]*forwardBytes
+}
+
+// forwardBytes 服务端转发的字节数, in 为访问方发往客户端, out 为客户端返回
+type forwardBytes struct {
+	in  int64
+	out int64
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		loginFailures: make(map[string]int64),
+		bytes:         make(map[string]*forwardBytes),
+	}
+	for _, reason := range loginFailReasons {
+		m.loginFailures[reason] = 0
+	}
+	return m
+}
+
+func (m *serverMetrics) connect(delta int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.connected += delta
+}
+
+func (m *serverMetrics) login(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if reason == "" {
+		m.loginSuccess++
+		return
+	}
+	m.loginFailures[reason]++
+}
+
+func (m *serverMetrics) portFailure() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.portFailures++
+}
+
+func (m *serverMetrics) relogin() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.relogins++
+}
+
+func (m *serverMetrics) sweep(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sweeps++
+	m.sweepSeconds += d.Seconds()
+	m.lastSweep = d.Seconds()
+}
+
+func (m *serverMetrics) addBytes(name string, in, out int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	b, ok := m.bytes[name]
+	if !ok {
+		b = &forwardBytes{}
+		m.bytes[name] = b
+	}
+	b.in += in
+	b.out += out
+}
+
+// countConn 统计访问方连接上的字节数, 计入客户端 name
+func (m *serverMetrics) countConn(name string, conn net.Conn) net.Conn {
+	return &countedConn{Conn: conn, name: name, metrics: m}
+}
+
+type countedConn struct {
+	net.Conn
+	name    string
+	metrics *serverMetrics
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.metrics.addBytes(c.name, int64(n), 0)
+	}
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.metrics.addBytes(c.name, 0, int64(n))
+	}
+	return n, err
+}
+
+// MetricsHandler GET /metrics, prometheus 文本格式
+func (s *STPServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.writeMetrics(w)
+}
+
+func (s *STPServer) writeMetrics(w io.Writer) {
+	clients := s.cliMgr.List()
+	known := len(clients)
+	online, onDemand, active := 0, 0, 0
+	for _, cli := range clients {
+		if !cli.IsOnline {
+			continue
+		}
+		online++
+		if cli.OnDemand {
+			onDemand++
+		}
+		if cli.Active {
+			active++
+		}
+	}
+	pool := s.portPool()
+
+	m := s.metrics
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	gauge(w, "stp_control_connections", "Open control connections, including not logged in", m.connected)
+	gauge(w, "stp_clients_online", "Logged in client sessions", online)
+	gauge(w, "stp_clients_known", "Clients in the registry, including offline", known)
+	gauge(w, "stp_clients_on_demand", "Online on demand clients", onDemand)
+	gauge(w, "stp_tunnels_active", "Online clients with an open tunnel", active)
+	gauge(w, "stp_port_pool_size", "Ports in portRange", pool.Total)
+	gauge(w, "stp_port_pool_used", "Ports assigned to tunnels", pool.Used)
+	gauge(w, "stp_port_pool_pinned", "Ports pinned to client names", pool.Pinned)
+	counter(w, "stp_port_assign_failures_total", "Failed port assignments", m.portFailures)
+	counter(w, "stp_login_success_total", "Successful logins", m.loginSuccess)
+	fmt.Fprintln(w, "# HELP stp_login_failures_total Failed logins by reason")
+	fmt.Fprintln(w, "# TYPE stp_login_failures_total counter")
+	for _, reason := range sortedKeys(m.loginFailures) {
+		fmt.Fprintf(w, "stp_login_failures_total{reason=%s} %d\n", labelValue(reason), m.loginFailures[reason])
+	}
+	counter(w, "stp_checker_relogins_total", "Relogin commands sent after port probe failed", m.relogins)
+	fmt.Fprintln(w, "# HELP stp_checker_sweep_duration_seconds Port probe sweep duration")
+	fmt.Fprintln(w, "# TYPE stp_checker_sweep_duration_seconds summary")
+	fmt.Fprintf(w, "stp_checker_sweep_duration_seconds_sum %g\n", m.sweepSeconds)
+	fmt.Fprintf(w, "stp_checker_sweep_duration_seconds_count %d\n", m.sweeps)
+	fmt.Fprintln(w, "# HELP stp_checker_last_sweep_duration_seconds Duration of the last port probe sweep")
+	fmt.Fprintln(w, "# TYPE stp_checker_last_sweep_duration_seconds gauge")
+	fmt.Fprintf(w, "stp_checker_last_sweep_duration_seconds %g\n", m.lastSweep)
+	fmt.Fprintln(w, "# HELP stp_client_forward_bytes_total Bytes forwarded by stpsrv per client, in to the client, out from the client")
+	fmt.Fprintln(w, "# TYPE stp_client_forward_bytes_total counter")
+	names := make([]string, 0, len(m.bytes))
+	for name := range m.bytes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := m.bytes[name]
+		fmt.Fprintf(w, "stp_client_forward_bytes_total{client=%s,direction=\"in\"} %d\n", labelValue(name), b.in)
+		fmt.Fprintf(w, "stp_client_forward_bytes_total{client=%s,direction=\"out\"} %d\n", labelValue(name), b.out)
+	}
+	fmt.Fprintln(w, "# HELP stp_client_reported_bytes_total Bytes forwarded by stpcli since it started, from the last traffic report")
+	fmt.Fprintln(w, "# TYPE stp_client_reported_bytes_total counter")
+	for _, cli := range clients {
+		if cli.Traffic != nil {
+			fmt.Fprintf(w, "stp_client_reported_bytes_total{client=%s,direction=\"in\"} %d\n", labelValue(cli.Name), cli.Traffic.BytesIn)
+			fmt.Fprintf(w, "stp_client_reported_bytes_total{client=%s,direction=\"out\"} %d\n", labelValue(cli.Name), cli.Traffic.BytesOut)
+		}
+	}
+	fmt.Fprintln(w, "# HELP stp_client_reported_active_conns Forwarded connections in progress, from the last traffic report")
+	fmt.Fprintln(w, "# TYPE stp_client_reported_active_conns gauge")
+	for _, cli := range clients {
+		if cli.Traffic != nil {
+			fmt.Fprintf(w, "stp_client_reported_active_conns{client=%s} %d\n", labelValue(cli.Name), cli.Traffic.Active)
+		}
+	}
+}
+
+func gauge(w io.Writer, name, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+func counter(w io.Writer, name, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func sortedKeys(values map[string]int64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelValue 客户端名只包含字母数字和 ._-, 旧记录中的名字按 prometheus 规则转义
+func labelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
@@ -0,0 +1,273 @@
+package stp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdleTimeout = 10 * time.Minute
+	// 等待客户端 ssh 隧道监听分配的端口
+	activateWait = 10 * time.Second
+)
+
+// connCounter 统计正在转发的连接, 判断按需隧道是否空闲
+type connCounter struct {
+	lock   sync.Mutex
+	active int
+	last   time.Time
+}
+
+func (c *connCounter) add() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.active++
+}
+
+func (c *connCounter) done() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.active--
+	c.last = time.Now()
+}
+
+func (c *connCounter) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.last = time.Now()
+}
+
+// idle 没有连接的时间, 有连接时返回 0
+func (c *connCounter) idle() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.active > 0 {
+		return 0
+	}
+	return time.Since(c.last)
+}
+
+// UseOnDemand 登录后只保持控制连接, 服务端需要时才打开隧道, 空闲超时后关闭
+func (s *STPClient) UseOnDemand(enable bool) {
+	s.onDemand = enable
+}
+
+// activate 服务端请求打开按需隧道, 在 Daemon 中执行
+func (s *STPClient) activate(disp *Dispatcher, cmd *STPCmd) {
+	resp := &STPLoginResp{}
+	err := json.Unmarshal(cmd.Data, resp)
+	if err == nil {
+		s.stopTunnel()
+		err = s.startTunnel(resp, s.wsTargets)
+	}
+	// 端口开始监听后再响应, 服务端不需要探测端口
+	if err == nil && s.tunnel != nil {
+		err = s.tunnel.WaitReady(activateWait)
+		if err != nil {
+			s.stopTunnel()
+		}
+	}
+	if err != nil {
+		log.Println("activate tunnel error", err.Error())
+		disp.replyError(cmd, err.Error())
+		return
+	}
+	timeout := time.Duration(resp.IdleTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultIdleTimeout
+	}
+	log.Println("tunnel activated, idle timeout", timeout)
+	s.conns.reset()
+	s.idleDone = make(chan struct{})
+	go s.watchIdle(disp, timeout, s.idleDone)
+	disp.Reply(cmd, nil)
+}
+
+// watchIdle 没有转发连接超过 timeout 时通知 Daemon 关闭隧道
+func (s *STPClient) watchIdle(disp *Dispatcher, timeout time.Duration, done chan struct{}) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if s.conns.idle() >= timeout {
+				s.events <- clientEvent{disp: disp, cmd: "deactivate", msg: fmt.Sprintf("idle for %s", timeout)}
+				return
+			}
+		}
+	}
+}
+
+// deactivate 关闭按需隧道, notify 为 true 时通知服务端回收端口
+func (s *STPClient) deactivate(disp *Dispatcher, reason string, notify bool) {
+	if s.idleDone == nil {
+		return
+	}
+	log.Println("deactivate tunnel,", reason)
+	s.stopTunnel()
+	if notify {
+		err := disp.Call("deactivate", &STPMsgData{Msg: reason}, nil)
+		if err != nil {
+			log.Println("deactivate error", err.Error())
+		}
+	}
+}
+
+func (s *STPClient) stopTunnel() {
+	if s.tunnel != nil {
+		s.tunnel.Stop()
+		s.tunnel = nil
+	}
+	if s.idleDone != nil {
+		close(s.idleDone)
+		s.idleDone = nil
+	}
+}
+
+// OnDemandIdleTimeout 按需隧道没有连接超过 timeout 后关闭
+func (s *STPServer) OnDemandIdleTimeout(timeout time.Duration) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	s.idleTimeout = timeout
+}
+
+// Activate 打开 id 或名字为 key 的按需客户端的隧道, 已经打开或不是按需客户端时直接返回
+func (s *STPServer) Activate(key string) (*Client, error) {
+	client, err := FindClient(s.cliMgr.Sessions(), key)
+	if err != nil {
+		return nil, fmt.Errorf("%s, or offline", err.Error())
+	}
+	if client.OnDemand {
+		err = s.activate(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshot := s.cliMgr.Snapshot(client)
+	if snapshot == nil {
+		return nil, fmt.Errorf("client %s offline", client.Name)
+	}
+	return snapshot, nil
+}
+
+// activate 分配端口后释放 tunnelLock 等待客户端响应, 等待期间隧道可以被关闭, 客户端也可以下线
+// 同时打开同一个客户端时, 后来的等待前一个完成
+func (s *STPServer) activate(client *Client) error {
+	resp, targets, activating, err := s.prepareActivate(client)
+	if err != nil || activating == nil {
+		return err
+	}
+	err = client.disp.Call("activate", resp, nil)
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+	if client.activating != activating {
+		return fmt.Errorf("client %s tunnel closed while activating", client.Name)
+	}
+	client.activating = nil
+	close(activating)
+	if err != nil {
+		s.closeTunnel(client)
+		s.cliMgr.SetTunnel(client, emptyPorts(targets), false)
+		return err
+	}
+	log.Println("tunnel activated:", client.Name, client.Port)
+	return nil
+}
+
+// prepareActivate 分配端口并标记正在打开, 隧道已经打开时 activating 为 nil
+func (s *STPServer) prepareActivate(client *Client) (*STPLoginResp, []*STPTarget, chan struct{}, error) {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+	for client.activating != nil {
+		activating := client.activating
+		client.tunnelLock.Unlock()
+		<-activating
+		client.tunnelLock.Lock()
+	}
+	if s.cliMgr.Get(client.ID) != client {
+		return nil, nil, nil, fmt.Errorf("client %s offline", client.Name)
+	}
+	if client.Active {
+		return nil, nil, nil, nil
+	}
+	targets := emptyPorts(client.Targets)
+	s.cfgLock.RLock()
+	idleTimeout := s.idleTimeout
+	s.cfgLock.RUnlock()
+	resp := &STPLoginResp{Name: client.Name, NameResult: NameAccepted, IdleTimeout: int(idleTimeout / time.Second)}
+	err := s.openTunnel(client, targets, resp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.cliMgr.SetTunnel(client, targets, true)
+	client.activating = make(chan struct{})
+	return resp, targets, client.activating, nil
+}
+
+// deactivate 关闭按需隧道并回收端口, 客户端保持在线, 隧道已经关闭时返回 false
+func (s *STPServer) deactivate(client *Client, reason string) bool {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+	if !client.Active {
+		return false
+	}
+	log.Println("deactivate tunnel:", client.Name, client.Port, reason)
+	s.closeTunnel(client)
+	s.cliMgr.SetTunnel(client, emptyPorts(client.Targets), false)
+	return true
+}
+
+// onDeactivate 客户端空闲超时后关闭了隧道, 在后台执行, 不阻塞读循环
+func (s *STPServer) onDeactivate(d *Dispatcher, cmd *STPCmd, sessions []*Client) error {
+	m := STPMsgData{}
+	json.Unmarshal(cmd.Data, &m)
+	go func() {
+		for _, client := range sessions {
+			if client.OnDemand {
+				s.deactivate(client, m.Msg)
+			}
+		}
+		d.Reply(cmd, nil)
+	}()
+	return nil
+}
+
+// SendDeactivate 通知客户端服务端已经关闭隧道
+func (s *STPServer) SendDeactivate(d *Dispatcher, msg string) error {
+	return d.Send("deactivate", STPMsgData{Msg: msg})
+}
+
+func emptyPorts(targets []*STPTarget) []*STPTarget {
+	empty := []*STPTarget{}
+	for _, target := range targets {
+		t := *target
+		t.Port = ""
+		empty = append(empty, &t)
+	}
+	return empty
+}
+
+// ActivateHandler POST /activate?client=<id|name>, 打开按需隧道并返回客户端信息
+func (s *STPServer) ActivateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := s.Activate(r.URL.Query().Get("client"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
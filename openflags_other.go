@@ -0,0 +1,16 @@
+//go:build !unix
+
+package stp
+
+import (
+	"fmt"
+	"os"
+)
+
+// openPartFile 打开 .stppart 文件, 没有 O_NOFOLLOW 时打开前检查是否为符号链接
+func openPartFile(path string, flag int) (*os.File, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("%s is a symlink", path)
+	}
+	return os.OpenFile(path, flag, 0644)
+}
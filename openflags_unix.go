@@ -0,0 +1,13 @@
+//go:build unix
+
+package stp
+
+import (
+	"os"
+	"syscall"
+)
+
+// openPartFile 打开 .stppart 文件, 检查之后被换成符号链接时打开失败
+func openPartFile(path string, flag int) (*os.File, error) {
+	return os.OpenFile(path, flag|syscall.O_NOFOLLOW, 0644)
+}
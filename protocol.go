@@ -0,0 +1,102 @@
+package stp
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// ProtocolVersion 控制协议版本
+// 1 0.0.3 及以前, 只有 login/heartBeat/relogin, 不发送 hello
+// 2 hello 协商版本和功能
+const ProtocolVersion = 2
+
+// 可协商的功能, 双方都支持时才使用
+const (
+	// FeatureTargets 一次登录转发多个目标
+	FeatureTargets = "targets"
+	// FeatureWsTransport 在控制连接上转发, 不需要 ssh
+	FeatureWsTransport = "ws"
+	// FeatureKick 客户端支持 kick 命令, 收到后不再重连
+	FeatureKick = "kick"
+	// FeatureExec 客户端执行服务端下发的命令
+	FeatureExec = "exec"
+	// FeatureFile 服务端和客户端之间传输文件
+	FeatureFile = "file"
+	// FeatureOnDemand 登录时不打开隧道, 服务端需要时下发 activate, 客户端在隧道开始监听后才响应
+	FeatureOnDemand = "ondemand"
+	// FeatureTraffic 客户端定期上报转发流量
+	FeatureTraffic = "traffic"
+	// FeatureRateLimit 服务端按客户端名下发限速
+	FeatureRateLimit = "ratelimit"
+)
+
+// Features 当前版本支持的功能
+var Features = []string{FeatureTargets, FeatureWsTransport, FeatureKick, FeatureExec, FeatureFile, FeatureOnDemand, FeatureTraffic, FeatureRateLimit}
+
+// STPHelloData 连接后第一条命令, 服务端返回协商后的版本和功能
+type STPHelloData struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// negotiate 取双方都支持的功能
+func negotiate(version int, features []string) *STPHelloData {
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	supported := make(map[string]bool)
+	for _, feature := range Features {
+		supported[feature] = true
+	}
+	common := []string{}
+	for _, feature := range features {
+		if supported[feature] {
+			common = append(common, feature)
+		}
+	}
+	return &STPHelloData{Version: version, Features: common}
+}
+
+// Hello 客户端和服务端协商协议版本, 旧服务端不认识 hello 时按版本 1 处理
+func (d *Dispatcher) Hello() error {
+	resp := &STPHelloData{}
+	err := d.Call("hello", &STPHelloData{Version: ProtocolVersion, Features: Features}, resp)
+	if respErr, ok := err.(*RespError); ok && respErr.ErrMsg == "Unknow CMD" {
+		// 0.0.3 server
+		log.Println("server protocol version 1")
+		d.conn.setPeer(1, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("server protocol version", resp.Version, "features", resp.Features)
+	d.conn.setPeer(resp.Version, resp.Features)
+	return nil
+}
+
+// onHello 服务端处理 hello
+func (d *Dispatcher) onHello(cmd *STPCmd) error {
+	hello := STPHelloData{}
+	err := json.Unmarshal(cmd.Data, &hello)
+	if err != nil {
+		return err
+	}
+	common := negotiate(hello.Version, hello.Features)
+	d.conn.setPeer(common.Version, common.Features)
+	log.Println("client protocol version", common.Version, "features", common.Features)
+	return d.Reply(cmd, common)
+}
+
+func (c *ControlConn) setPeer(version int, features []string) {
+	c.peerVersion = version
+	c.peerFeatures = make(map[string]bool)
+	for _, feature := range features {
+		c.peerFeatures[feature] = true
+	}
+}
+
+// Supports 对端是否支持协商后的功能, 没有 hello 的连接按版本 1 处理, 不支持任何功能
+func (c *ControlConn) Supports(feature string) bool {
+	return c.peerFeatures[feature]
+}
@@ -0,0 +1,344 @@
+package stp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限速时每次最多写入的字节数, 避免一次写入等待太久
+const rateChunkSize = 4096
+
+// STPRateLimit 每秒字节数, 0 为不限速
+// up 为客户端发出(本地服务返回给访问方), down 为客户端收到(访问方发往本地服务)
+type STPRateLimit struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// STPRateLimits 服务端下发的限速, Up, Down 为整个客户端, Tunnels 按转发目标的 Key 单独限速
+type STPRateLimits struct {
+	STPRateLimit
+	Tunnels map[string]*STPRateLimit `json:"tunnels,omitempty"`
+}
+
+func (r *STPRateLimit) String() string {
+	if r == nil {
+		return "unlimited"
+	}
+	return fmt.Sprintf("up %s down %s", formatRate(r.Up), formatRate(r.Down))
+}
+
+// ParseRateLimit 解析 up/down, 如 512K/2M, 只有一个值时上下行相同, 0 或空为不限速
+func ParseRateLimit(s string) (*STPRateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return &STPRateLimit{}, nil
+	}
+	items := strings.Split(s, "/")
+	if len(items) > 2 {
+		return nil, fmt.Errorf("invalid rate %s, eg 512K/2M", s)
+	}
+	up, err := parseRate(items[0])
+	if err != nil {
+		return nil, err
+	}
+	down := up
+	if len(items) == 2 {
+		down, err = parseRate(items[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &STPRateLimit{Up: up, Down: down}, nil
+}
+
+func parseRate(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %s, bytes per second, eg 512K", s)
+	}
+	return n * unit, nil
+}
+
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%dB/s", rate)
+}
+
+// stricter 取两个限速中更小的值, 0 为不限速
+func stricter(a, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+	return b
+}
+
+// clock 令牌桶使用的时钟, 可以替换为假时钟
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// tokenBucket 每秒补充 rate 个令牌, 最多积累 rate 个, rate 为 0 时不限速
+// 令牌不够时先扣成负数再等待, 并发写入按调用顺序排队
+type tokenBucket struct {
+	lock   sync.Mutex
+	clock  clock
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(c clock) *tokenBucket {
+	return &tokenBucket{clock: c, last: c.Now()}
+}
+
+// setRate 修改限速, 已经在等待的写入不受影响
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+// refill 需要持有锁
+func (b *tokenBucket) refill() {
+	now := b.clock.Now()
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.last = now
+}
+
+// wait 取 n 个令牌, 不够时等待
+func (b *tokenBucket) wait(n int) {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return
+	}
+	b.refill()
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.lock.Unlock()
+	if delay > 0 {
+		b.clock.Sleep(delay)
+	}
+}
+
+func (b *tokenBucket) limited() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate > 0
+}
+
+// rateLimiter 上下行令牌桶, 客户端所有转发连接共用一个, 每个转发目标另有一个
+type rateLimiter struct {
+	up   *tokenBucket
+	down *tokenBucket
+}
+
+func newRateLimiter(c clock) *rateLimiter {
+	return &rateLimiter{up: newTokenBucket(c), down: newTokenBucket(c)}
+}
+
+func (l *rateLimiter) set(limit *STPRateLimit) {
+	if limit == nil {
+		limit = &STPRateLimit{}
+	}
+	l.up.setRate(limit.Up)
+	l.down.setRate(limit.Down)
+}
+
+// limitWriter 写入前依次从每个令牌桶取令牌, 速度不超过最小的限速
+type limitWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+}
+
+// newLimitWriter 没有令牌桶时不限速
+func newLimitWriter(w io.Writer, buckets ...*tokenBucket) io.Writer {
+	if len(buckets) == 0 {
+		return w
+	}
+	return &limitWriter{w: w, buckets: buckets}
+}
+
+func (lw *limitWriter) limited() bool {
+	for _, bucket := range lw.buckets {
+		if bucket.limited() {
+			return true
+		}
+	}
+	return false
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if !lw.limited() {
+		return lw.w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > rateChunkSize {
+			n = rateChunkSize
+		}
+		for _, bucket := range lw.buckets {
+			bucket.wait(n)
+		}
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// UseRateLimit 设置本机的上下行限速, 服务端下发的限速更小时使用服务端的
+func (s *STPClient) UseRateLimit(limit *STPRateLimit) {
+	s.rateLock.Lock()
+	s.localRate = limit
+	s.rateLock.Unlock()
+	s.applyRate()
+}
+
+// setPushedRate 服务端下发的限速, nil 为服务端不限速
+func (s *STPClient) setPushedRate(limits *STPRateLimits) {
+	s.rateLock.Lock()
+	s.pushedRate, s.tunnelRates = nil, nil
+	if limits != nil {
+		limit := limits.STPRateLimit
+		s.pushedRate, s.tunnelRates = &limit, limits.Tunnels
+	}
+	s.rateLock.Unlock()
+	if limits != nil {
+		for key, limit := range limits.Tunnels {
+			log.Println("tunnel rate limit:", key, limit)
+		}
+	}
+	s.applyRate()
+}
+
+func (s *STPClient) applyRate() {
+	s.rateLock.Lock()
+	defer s.rateLock.Unlock()
+	for key, limiter := range s.tunnelLimiters {
+		limiter.set(s.tunnelRates[key])
+	}
+	effective := &STPRateLimit{}
+	for _, limit := range []*STPRateLimit{s.localRate, s.pushedRate} {
+		if limit != nil {
+			effective.Up = stricter(effective.Up, limit.Up)
+			effective.Down = stricter(effective.Down, limit.Down)
+		}
+	}
+	if s.rate != nil && *s.rate == *effective {
+		return
+	}
+	s.rate = effective
+	s.limiter.set(effective)
+	log.Println("rate limit:", effective)
+}
+
+// tunnelLimiter 转发目标 key 的令牌桶, 服务端没有单独限速时不限速
+func (s *STPClient) tunnelLimiter(key string) *rateLimiter {
+	s.rateLock.Lock()
+	defer s.rateLock.Unlock()
+	limiter, ok := s.tunnelLimiters[key]
+	if !ok {
+		limiter = newRateLimiter(realClock{})
+		limiter.set(s.tunnelRates[key])
+		s.tunnelLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// onRateLimit 服务端重新加载配置后下发的限速
+func (s *STPClient) onRateLimit(cmd *STPCmd) error {
+	limit := &STPRateLimits{}
+	err := json.Unmarshal(cmd.Data, limit)
+	if err != nil {
+		return err
+	}
+	s.setPushedRate(limit)
+	return nil
+}
+
+// RateLimits 按客户端名设置限速, 登录时下发, 已经在线的客户端立即生效
+// key 为 "客户端名/转发目标" 时单独限制该转发目标, 转发目标为标签, 没有标签时为 host:port
+func (s *STPServer) RateLimits(limits map[string]*STPRateLimit) {
+	s.cfgLock.Lock()
+	s.rateLimits = limits
+	s.cfgLock.Unlock()
+	for _, client := range s.cliMgr.Sessions() {
+		if !client.conn.Supports(FeatureRateLimit) {
+			continue
+		}
+		err := client.disp.Send("rateLimit", s.rateLimit(client.Name))
+		if err != nil {
+			log.Println("send rate limit error", client.Name, err.Error())
+		}
+	}
+}
+
+// rateLimit 客户端名对应的限速, 没有配置时不限速
+func (s *STPServer) rateLimit(name string) *STPRateLimits {
+	s.cfgLock.RLock()
+	defer s.cfgLock.RUnlock()
+	limits := &STPRateLimits{}
+	prefix := name + "/"
+	for key, limit := range s.rateLimits {
+		if limit == nil {
+			continue
+		}
+		if key == name {
+			limits.STPRateLimit = *limit
+		} else if strings.HasPrefix(key, prefix) {
+			if limits.Tunnels == nil {
+				limits.Tunnels = make(map[string]*STPRateLimit)
+			}
+			limits.Tunnels[strings.TrimPrefix(key, prefix)] = limit
+		}
+	}
+	return limits
+}
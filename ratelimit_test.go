@@ -0,0 +1,186 @@
+package stp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock Sleep 只推进时间, 不真正等待
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// copyTime 写入 n 字节经过的假时间
+func copyTime(t *testing.T, c *fakeClock, w io.Writer, n int) time.Duration {
+	start := c.Now()
+	written, err := io.Copy(w, bytes.NewReader(make([]byte, n)))
+	if err != nil || written != int64(n) {
+		t.Fatalf("copy %d of %d bytes: %v", written, n, err)
+	}
+	return c.Now().Sub(start)
+}
+
+func assertDuration(t *testing.T, name string, got, expected time.Duration) {
+	t.Helper()
+	diff := got - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > 10*time.Millisecond {
+		t.Fatalf("%s took %s, expected %s", name, got, expected)
+	}
+}
+
+func TestTokenBucketSteadyRate(t *testing.T) {
+	c := newFakeClock()
+	b := newTokenBucket(c)
+	b.setRate(100 << 10)
+	w := newLimitWriter(ioutil.Discard, b)
+	// 新的令牌桶没有积累, 1M 按 100K/s 需要 10.24s
+	assertDuration(t, "1M at 100K/s", copyTime(t, c, w, 1<<20), 10240*time.Millisecond)
+	assertDuration(t, "next 200K", copyTime(t, c, w, 200<<10), 2*time.Second)
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	c := newFakeClock()
+	b := newTokenBucket(c)
+	b.setRate(100 << 10)
+	w := newLimitWriter(ioutil.Discard, b)
+	// 空闲时最多积累 1 秒的令牌
+	c.Sleep(10 * time.Second)
+	assertDuration(t, "burst 100K", copyTime(t, c, w, 100<<10), 0)
+	c.Sleep(10 * time.Second)
+	assertDuration(t, "300K after idle", copyTime(t, c, w, 300<<10), 2*time.Second)
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	c := newFakeClock()
+	b := newTokenBucket(c)
+	b.setRate(100 << 10)
+	w := newLimitWriter(ioutil.Discard, b)
+	assertDuration(t, "200K at 100K/s", copyTime(t, c, w, 200<<10), 2*time.Second)
+	b.setRate(50 << 10)
+	assertDuration(t, "200K at 50K/s", copyTime(t, c, w, 200<<10), 4*time.Second)
+	// 降低限速时积累的令牌不超过新的限速
+	c.Sleep(10 * time.Second)
+	b.setRate(400 << 10)
+	b.setRate(10 << 10)
+	assertDuration(t, "30K at 10K/s after idle", copyTime(t, c, w, 30<<10), 2*time.Second)
+	b.setRate(0)
+	assertDuration(t, "unlimited", copyTime(t, c, w, 10<<20), 0)
+}
+
+func TestLimitWriterBuckets(t *testing.T) {
+	c := newFakeClock()
+	client, tunnel := newTokenBucket(c), newTokenBucket(c)
+	client.setRate(200 << 10)
+	tunnel.setRate(50 << 10)
+	w := newLimitWriter(ioutil.Discard, client, tunnel)
+	assertDuration(t, "200K under 200K/s and 50K/s", copyTime(t, c, w, 200<<10), 4*time.Second)
+	// 客户端的令牌桶在等待隧道限速时已积累 1 秒
+	tunnel.setRate(0)
+	assertDuration(t, "400K under 200K/s", copyTime(t, c, w, 400<<10), time.Second)
+	client.setRate(0)
+	if _, ok := newLimitWriter(ioutil.Discard).(*limitWriter); ok {
+		t.Fatal("writer without buckets should not be limited")
+	}
+}
+
+func TestStricter(t *testing.T) {
+	cases := []struct{ a, b, expected int64 }{
+		{0, 0, 0},
+		{0, 100, 100},
+		{100, 0, 100},
+		{100, 200, 100},
+		{300, 200, 200},
+	}
+	for _, c := range cases {
+		if got := stricter(c.a, c.b); got != c.expected {
+			t.Fatalf("stricter(%d, %d) = %d, expected %d", c.a, c.b, got, c.expected)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	valid := map[string]STPRateLimit{
+		"":        {},
+		"0":       {},
+		"100/0":   {Up: 100},
+		"1M":      {Up: 1 << 20, Down: 1 << 20},
+		"512K/2M": {Up: 512 << 10, Down: 2 << 20},
+		"1g/1k":   {Up: 1 << 30, Down: 1 << 10},
+	}
+	for s, expected := range valid {
+		limit, err := ParseRateLimit(s)
+		if err != nil || *limit != expected {
+			t.Fatalf("%q: got %v, %v", s, limit, err)
+		}
+	}
+	for _, s := range []string{"x", "-1", "1T", "1M/2M/3M"} {
+		if _, err := ParseRateLimit(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
+
+func TestClientRateLimits(t *testing.T) {
+	cli := NewSTPClient("key", "ws://127.0.0.1", nil, "dev")
+	cli.UseRateLimit(&STPRateLimit{Up: 1 << 20, Down: 256 << 10})
+	web := cli.tunnelLimiter("web")
+	cli.setPushedRate(&STPRateLimits{
+		STPRateLimit: STPRateLimit{Up: 64 << 10},
+		Tunnels:      map[string]*STPRateLimit{"web": {Down: 32 << 10}},
+	})
+	if *cli.rate != (STPRateLimit{Up: 64 << 10, Down: 256 << 10}) {
+		t.Fatalf("client rate %v", cli.rate)
+	}
+	if web.up.rate != 0 || web.down.rate != 32<<10 {
+		t.Fatalf("web rate up %d down %d", web.up.rate, web.down.rate)
+	}
+	if ssh := cli.tunnelLimiter("localhost:22"); ssh.up.limited() || ssh.down.limited() {
+		t.Fatal("tunnel without limit should not be limited")
+	}
+	// 服务端取消限速
+	cli.setPushedRate(nil)
+	if *cli.rate != (STPRateLimit{Up: 1 << 20, Down: 256 << 10}) || web.down.limited() {
+		t.Fatalf("after reset client rate %v, web limited %v", cli.rate, web.down.limited())
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := NewSTPServer("key", "127.0.0.1:0", "127.0.0.1:22", "", "stp", "47300-47301")
+	s.RateLimits(map[string]*STPRateLimit{
+		"dev":     {Up: 100},
+		"dev/web": {Down: 50},
+		"dev2/ui": {Up: 10},
+	})
+	limits := s.rateLimit("dev")
+	if limits.STPRateLimit != (STPRateLimit{Up: 100}) || len(limits.Tunnels) != 1 || *limits.Tunnels["web"] != (STPRateLimit{Down: 50}) {
+		t.Fatalf("dev limits %+v", limits)
+	}
+	limits = s.rateLimit("dev2")
+	if limits.STPRateLimit != (STPRateLimit{}) || len(limits.Tunnels) != 1 {
+		t.Fatalf("dev2 limits %+v", limits)
+	}
+}
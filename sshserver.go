@@ -0,0 +1,314 @@
+package stp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer 内置 ssh 服务, 不依赖系统 sshd
+// 只接受 tcpip-forward 请求, 并且端口必须是登录时分配给该临时凭证的端口, 拒绝 shell 和其他转发
+type SSHServer struct {
+	listenAddr string
+	bindHost   string
+	hostKey    ssh.Signer
+	config     *ssh.ServerConfig
+
+	lock         sync.Mutex
+	grants       map[string]*sshGrant // 临时公钥 -> 授权
+	onDisconnect func(cred *TunnelCredential)
+	onForward    func(cred *TunnelCredential, conn net.Conn) net.Conn
+}
+
+type sshGrant struct {
+	cred  *TunnelCredential
+	ports map[string]bool
+	conns map[*ssh.ServerConn]bool
+}
+
+// forward 请求和 forwarded-tcpip channel 的数据格式, 见 RFC 4254 7.1, 7.2
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// NewSSHServer hostKeyPath 不存在时自动生成, 转发端口只监听 bindHost, 同 sshd GatewayPorts no
+func NewSSHServer(listenAddr, hostKeyPath, bindHost string) (*SSHServer, error) {
+	hostKey, err := loadOrCreateHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	ss := &SSHServer{
+		listenAddr: listenAddr,
+		bindHost:   bindHost,
+		hostKey:    hostKey,
+		grants:     make(map[string]*sshGrant),
+	}
+	ss.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			ss.lock.Lock()
+			defer ss.lock.Unlock()
+			if _, ok := ss.grants[string(key.Marshal())]; !ok {
+				return nil, fmt.Errorf("unknown public key for %s", conn.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"key": string(key.Marshal())}}, nil
+		},
+	}
+	ss.config.AddHostKey(hostKey)
+	return ss, nil
+}
+
+func loadOrCreateHostKey(path string) (ssh.Signer, error) {
+	if !FileExist(path) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("generate ssh host key", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func (ss *SSHServer) HostKeyFingerprint() string {
+	return ssh.FingerprintSHA256(ss.hostKey.PublicKey())
+}
+
+// Authorize 允许临时凭证转发分配的端口
+func (ss *SSHServer) Authorize(cred *TunnelCredential) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	grant := &sshGrant{cred: cred, ports: make(map[string]bool), conns: make(map[*ssh.ServerConn]bool)}
+	for _, port := range cred.Ports {
+		grant.ports[port] = true
+	}
+	ss.grants[string(cred.PublicKey.Marshal())] = grant
+	return nil
+}
+
+// Revoke 收回授权并断开使用该凭证的连接
+func (ss *SSHServer) Revoke(cred *TunnelCredential) error {
+	ss.lock.Lock()
+	key := string(cred.PublicKey.Marshal())
+	conns := []*ssh.ServerConn{}
+	if grant, ok := ss.grants[key]; ok {
+		for conn := range grant.conns {
+			conns = append(conns, conn)
+		}
+	}
+	delete(ss.grants, key)
+	ss.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// OnDisconnect 授权未收回时 ssh 连接断开, 调用 fn 通知转发已经结束
+func (ss *SSHServer) OnDisconnect(fn func(cred *TunnelCredential)) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.onDisconnect = fn
+}
+
+// OnForward 转发端口收到连接时调用 fn, 返回的连接代替原连接转发
+func (ss *SSHServer) OnForward(fn func(cred *TunnelCredential, conn net.Conn) net.Conn) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.onForward = fn
+}
+
+func (ss *SSHServer) Start() error {
+	listener, err := net.Listen("tcp", ss.listenAddr)
+	if err != nil {
+		return err
+	}
+	log.Println("ssh server listen on", ss.listenAddr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("ssh server accept", err.Error())
+				return
+			}
+			go ss.handleConn(conn)
+		}
+	}()
+	return nil
+}
+
+func (ss *SSHServer) handleConn(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, ss.config)
+	if err != nil {
+		log.Println("ssh handshake error", netConn.RemoteAddr().String(), err.Error())
+		netConn.Close()
+		return
+	}
+	key := conn.Permissions.Extensions["key"]
+	ss.lock.Lock()
+	grant, ok := ss.grants[key]
+	if ok {
+		grant.conns[conn] = true
+	}
+	ss.lock.Unlock()
+	if !ok {
+		// revoked during handshake
+		conn.Close()
+		return
+	}
+	log.Println("ssh client connect:", conn.RemoteAddr().String())
+
+	listeners := make(map[string]net.Listener)
+	var listenersLock sync.Mutex
+	defer func() {
+		listenersLock.Lock()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		listenersLock.Unlock()
+		ss.lock.Lock()
+		delete(grant.conns, conn)
+		_, granted := ss.grants[key]
+		onDisconnect := ss.onDisconnect
+		ss.lock.Unlock()
+		log.Println("ssh client disconnect:", conn.RemoteAddr().String())
+		if granted && onDisconnect != nil {
+			onDisconnect(grant.cred)
+		}
+	}()
+
+	// no shell, no direct-tcpip
+	go func() {
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "only remote port forwarding is allowed")
+		}
+	}()
+
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			forward := tcpipForwardRequest{}
+			if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port := strconv.Itoa(int(forward.BindPort))
+			ss.lock.Lock()
+			allowed := grant.ports[port]
+			ss.lock.Unlock()
+			if !allowed {
+				log.Println("ssh forward port not allowed:", port, conn.RemoteAddr().String())
+				req.Reply(false, nil)
+				continue
+			}
+			listener, err := net.Listen("tcp", net.JoinHostPort(ss.bindHost, port))
+			if err != nil {
+				log.Println("ssh forward listen error", err.Error())
+				req.Reply(false, nil)
+				continue
+			}
+			listenersLock.Lock()
+			listeners[port] = listener
+			listenersLock.Unlock()
+			go ss.serveForward(conn, grant.cred, listener, forward)
+			req.Reply(true, nil)
+		case "cancel-tcpip-forward":
+			forward := tcpipForwardRequest{}
+			if err := ssh.Unmarshal(req.Payload, &forward); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port := strconv.Itoa(int(forward.BindPort))
+			listenersLock.Lock()
+			listener, ok := listeners[port]
+			delete(listeners, port)
+			listenersLock.Unlock()
+			if ok {
+				listener.Close()
+			}
+			req.Reply(ok, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (ss *SSHServer) serveForward(conn *ssh.ServerConn, cred *TunnelCredential, listener net.Listener, forward tcpipForwardRequest) {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			originHost, originPort, _ := net.SplitHostPort(local.RemoteAddr().String())
+			originPortInt, _ := strconv.Atoi(originPort)
+			payload := ssh.Marshal(&forwardedTCPPayload{
+				Addr:       forward.BindAddr,
+				Port:       forward.BindPort,
+				OriginAddr: originHost,
+				OriginPort: uint32(originPortInt),
+			})
+			channel, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				log.Println("ssh open forwarded channel error", err.Error())
+				local.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			ss.lock.Lock()
+			onForward := ss.onForward
+			ss.lock.Unlock()
+			if onForward != nil {
+				local = onForward(cred, local)
+			}
+			pipeChannel(local, channel)
+		}()
+	}
+}
+
+// pipeChannel 双向拷贝, 任意一端结束后关闭两端
+func pipeChannel(local net.Conn, channel ssh.Channel) {
+	defer local.Close()
+	defer channel.Close()
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(channel, local)
+		done <- true
+	}()
+	go func() {
+		io.Copy(local, channel)
+		done <- true
+	}()
+	<-done
+}
@@ -1,14 +1,19 @@
 package stp
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+const sshKeepAlive = 30 * time.Second
+
 type Endpoint struct {
 	Host string
 	Port string
@@ -18,56 +23,154 @@ func (endpoint *Endpoint) String() string {
 	return fmt.Sprintf("%s:%s", endpoint.Host, endpoint.Port)
 }
 
-type SSHtunnel struct {
+// SSHForward 一条反向转发, 服务端 Remote 端口的连接转发到客户端 Local
+type SSHForward struct {
 	Local  *Endpoint
-	Server *Endpoint
 	Remote *Endpoint
+	limit  *rateLimiter // 转发目标单独的限速, 可以为空
+}
+
+type SSHtunnel struct {
+	Server   *Endpoint
+	Forwards []*SSHForward
 
 	Config   *ssh.ClientConfig
 	StopConn chan bool
+
+	conns    *connCounter  // 统计转发中的连接, 可以为空
+	traffic  *trafficStats // 统计转发流量, 可以为空
+	limiter  *rateLimiter  // 限速, 可以为空
+	doneOnce sync.Once
+	done     chan struct{}
+	ready    chan struct{}
+}
+
+// doneChan Start 返回后关闭
+func (tunnel *SSHtunnel) doneChan() chan struct{} {
+	tunnel.doneOnce.Do(func() {
+		tunnel.done = make(chan struct{})
+		tunnel.ready = make(chan struct{})
+	})
+	return tunnel.done
+}
+
+// readyChan 所有远端端口开始监听后关闭, 和 doneChan 一起初始化
+func (tunnel *SSHtunnel) readyChan() chan struct{} {
+	tunnel.doneChan()
+	return tunnel.ready
 }
 
+// WaitReady 等待所有远端端口开始监听, Start 提前返回或超时时返回错误
+func (tunnel *SSHtunnel) WaitReady(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-tunnel.readyChan():
+		return nil
+	case <-tunnel.doneChan():
+		select {
+		case <-tunnel.readyChan():
+			return nil
+		default:
+		}
+		return errors.New("ssh tunnel closed before listening")
+	case <-timer.C:
+		return fmt.Errorf("ssh tunnel not listening after %s", timeout)
+	}
+}
+
+type forwardConn struct {
+	conn    net.Conn
+	forward *SSHForward
+}
+
+// Start 阻塞直到 Stop 或 ssh 连接断开, ssh 连接断开时返回错误
 func (tunnel *SSHtunnel) Start() error {
+	defer close(tunnel.doneChan())
 	// Connect to SSH remote server using serverEndpoint
 	serverConn, err := ssh.Dial("tcp", tunnel.Server.String(), tunnel.Config)
 	if err != nil {
-		log.Println(fmt.Printf("Dial INTO remote server error: %s", err))
+		log.Printf("Dial INTO remote server error: %s", err)
 		return err
 	}
 
-	// Listen on remote server port
-	listener, err := serverConn.Listen("tcp", tunnel.Remote.String())
-	if err != nil {
-		log.Println(fmt.Printf("Listen open port ON remote server error: %s", err))
-		return err
-	}
-	defer listener.Close()
-
-	newConn := make(chan net.Conn)
+	defer serverConn.Close()
+	sshClosed := make(chan error, 1)
+	go func() {
+		sshClosed <- serverConn.Wait()
+	}()
+	// 网络静默断开时 Wait 不会返回, 用 keepalive 请求探测
 	go func() {
-		for {
-			conn, err := listener.Accept()
+		ticker := time.NewTicker(sshKeepAlive)
+		defer ticker.Stop()
+		for range ticker.C {
+			timeout := time.AfterFunc(sshKeepAlive, func() { serverConn.Close() })
+			_, _, err := serverConn.SendRequest("keepalive@openssh.com", true, nil)
+			timeout.Stop()
 			if err != nil {
-				log.Println("accept ", err)
+				serverConn.Close()
 				return
 			}
-			newConn <- conn
 		}
 	}()
 
+	// Listen on remote server ports, all forwards share one ssh connection
+	newConn := make(chan forwardConn)
+	done := make(chan struct{})
+	listeners := []net.Listener{}
+	defer func() {
+		close(done)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for _, forward := range tunnel.Forwards {
+		listener, err := serverConn.Listen("tcp", forward.Remote.String())
+		if err != nil {
+			log.Printf("Listen open port %s ON remote server error: %s", forward.Remote.Port, err)
+			return err
+		}
+		listeners = append(listeners, listener)
+		go func(listener net.Listener, forward *SSHForward) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					log.Println("accept ", err)
+					return
+				}
+				select {
+				case newConn <- forwardConn{conn, forward}:
+				case <-done:
+					conn.Close()
+					return
+				}
+			}
+		}(listener, forward)
+	}
+	close(tunnel.readyChan())
+
 	// handle incoming connections on reverse forwarded tunnel
 	for {
 		select {
 		case remote := <-newConn:
-			// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
-			local, err := net.Dial("tcp", tunnel.Local.String())
-			if err != nil {
-				log.Fatalln(fmt.Printf("Dial INTO local service error: %s", err))
-			}
-			go handleClient(remote, local)
+			go func(remote forwardConn) {
+				if tunnel.conns != nil {
+					tunnel.conns.add()
+					defer tunnel.conns.done()
+				}
+				// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
+				local, err := net.Dial("tcp", remote.forward.Local.String())
+				if err != nil {
+					log.Printf("Dial INTO local service %s error: %s", remote.forward.Local, err)
+					remote.conn.Close()
+					return
+				}
+				handleClient(remote.conn, local, tunnel.traffic.open(remote.conn.RemoteAddr().String(), remote.forward.Local.String()), tunnel.limiter, remote.forward.limit)
+			}(remote)
+		case err := <-sshClosed:
+			return fmt.Errorf("ssh connection closed: %v", err)
 		case <-tunnel.StopConn:
 			// stop tunnel
-			listener.Close()
 			tunnel.StopConn <- true
 			return nil
 		}
@@ -75,7 +178,12 @@ func (tunnel *SSHtunnel) Start() error {
 }
 
 func (tunnel *SSHtunnel) Stop() {
-	tunnel.StopConn <- true
+	select {
+	case tunnel.StopConn <- true:
+	case <-tunnel.doneChan():
+		log.Println("tunnel already stoped")
+		return
+	}
 	log.Println("send the stop signal")
 	stoped := <-tunnel.StopConn
 	if stoped {
@@ -86,24 +194,33 @@ func (tunnel *SSHtunnel) Stop() {
 // From https://sosedoff.com/2015/05/25/ssh-port-forwarding-with-go.html
 // Handle local client connections and tunnel data to the remote server
 // Will use io.Copy - http://golang.org/pkg/io/#Copy
-func handleClient(client net.Conn, remote net.Conn) {
+// stat 不为 nil 时统计流量, limits 中每个不为 nil 的都限速, client 发往 remote 为 in(下行)
+func handleClient(client net.Conn, remote net.Conn, stat *tunnelStat, limits ...*rateLimiter) {
+	defer stat.close()
 	defer client.Close()
-	chDone := make(chan bool)
+	defer remote.Close()
+	up, down := []*tokenBucket{}, []*tokenBucket{}
+	for _, limit := range limits {
+		if limit != nil {
+			up, down = append(up, limit.up), append(down, limit.down)
+		}
+	}
+	chDone := make(chan bool, 2)
 
 	// Start remote -> local data transfer
 	go func() {
-		_, err := io.Copy(client, remote)
+		_, err := io.Copy(newLimitWriter(&statWriter{client, func(n int64) { stat.add(0, n) }}, up...), remote)
 		if err != nil && err != io.EOF {
-			log.Println(fmt.Sprintf("error while copy remote->local: %s", err))
+			log.Printf("error while copy remote->local: %s", err)
 		}
 		chDone <- true
 	}()
 
 	// Start local -> remote data transfer
 	go func() {
-		_, err := io.Copy(remote, client)
+		_, err := io.Copy(newLimitWriter(&statWriter{remote, func(n int64) { stat.add(n, 0) }}, down...), client)
 		if err != nil && err != io.EOF {
-			log.Println(fmt.Sprintf("error while copy local->remote: %s", err))
+			log.Printf("error while copy local->remote: %s", err)
 		}
 		chDone <- true
 	}()
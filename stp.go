@@ -1,12 +1,17 @@
 package stp
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,192 +21,419 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// STPCmd 控制命令, 需要响应的命令带 id, 响应带同样的 id
 type STPCmd struct {
+	ID      uint64 `json:"id,omitempty"`
 	CmdType string `json:"type"`
 	Data    []byte `json:"data"`
 }
 
 type STPLoginData struct {
-	AuthKey string `json:"authKey"`
-	Name    string `json:"name"`
+	AuthKey   string       `json:"authKey"`
+	Name      string       `json:"name"`
+	Targets   []*STPTarget `json:"targets"`
+	Transport string       `json:"transport"`
+	OnDemand  bool         `json:"onDemand,omitempty"`
 }
 
+const (
+	// TransportSSH 通过 ssh 反向转发
+	TransportSSH = "ssh"
+	// TransportWs 直接在 websocket 控制连接上转发, 不需要 ssh
+	TransportWs = "ws"
+)
+
 type STPHBData struct {
 	Msg string `json:"msg"`
 }
 
+// STPMsgData relogin, kick 命令
+type STPMsgData struct {
+	Msg string `json:"msg"`
+}
+
+// STPLoginResp login 响应, 旧服务端没有 ports, name, nameResult, transport, hostKeys
+// 按需隧道登录时只返回 onDemand, 端口和 ssh 信息在 activate 命令中下发
+type STPLoginResp struct {
+	Port        string         `json:"port"`
+	Ports       []*STPTarget   `json:"ports"`
+	PublicKey   string         `json:"publicKey"`
+	Name        string         `json:"name"`
+	NameResult  string         `json:"nameResult"`
+	Transport   string         `json:"transport"`
+	PrivateKey  string         `json:"privateKey,omitempty"`
+	SSHUser     string         `json:"sshUser,omitempty"`
+	SSHAddr     string         `json:"sshAddr,omitempty"`
+	HostKeys    []string       `json:"hostKeys,omitempty"`
+	OnDemand    bool           `json:"onDemand,omitempty"`
+	IdleTimeout int            `json:"idleTimeout,omitempty"` // 秒
+	RateLimit   *STPRateLimits `json:"rateLimit,omitempty"`
+}
+
 type STPClient struct {
 	authKey   string
 	serverUrl string
-	localPort string
+	targets   []*STPTarget
 	name      string
+	transport string
 
-	conn   *websocket.Conn
-	tunnel *SSHtunnel
+	conn      *ControlConn
+	disp      *Dispatcher
+	events    chan clientEvent
+	tunnel    *SSHtunnel
+	hostKeys  *HostKeyPinner
+	tlsConfig *tls.Config
+	execAllow []string
+	fileRoot  string
+
+	// 按需隧道, 只在 Daemon 中修改
+	onDemand     bool
+	demandTunnel bool // 本次登录为按需隧道
+	wsTargets    *wsForward
+	idleDone     chan struct{}
+	conns        *connCounter
+
+	traffic *trafficStats
+
+	// 限速, limiter 由所有转发连接共用, tunnelLimiters 按转发目标的 Key
+	rateLock       sync.Mutex
+	localRate      *STPRateLimit
+	pushedRate     *STPRateLimit
+	tunnelRates    map[string]*STPRateLimit
+	rate           *STPRateLimit
+	limiter        *rateLimiter
+	tunnelLimiters map[string]*rateLimiter
 }
 
-func NewSTPClient(authKey, serverUrl, localPort, name string) *STPClient {
+// clientEvent 读循环通知 Daemon 的事件, disp 用来忽略旧连接的事件
+type clientEvent struct {
+	disp *Dispatcher
+	cmd  string // 为空时表示连接断开
+	msg  string
+	req  *STPCmd // 需要 Daemon 回复的命令
+}
+
+func NewSTPClient(authKey, serverUrl string, targets []*STPTarget, name string) *STPClient {
 	client := &STPClient{
 		authKey:   authKey,
 		serverUrl: serverUrl,
-		localPort: localPort,
+		targets:   targets,
 		name:      name,
+		transport: TransportSSH,
+		events:    make(chan clientEvent, 4),
+		conns:     &connCounter{},
+		traffic:   newTrafficStats(),
+		limiter:   newRateLimiter(realClock{}),
+		hostKeys:  NewHostKeyPinner(DefaultKnownHostsPath(), ""),
+
+		tunnelLimiters: make(map[string]*rateLimiter),
 	}
 	return client
 }
 
+// UseTransport 选择转发方式 TransportSSH 或 TransportWs
+func (s *STPClient) UseTransport(transport string) {
+	s.transport = transport
+}
+
+// UseTLS 使用 wss 连接 stpsrv 时的 tls 配置
+func (s *STPClient) UseTLS(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// PinHostKey 设置 known hosts 文件, fingerprint 不为空时只信任该指纹
+func (s *STPClient) PinHostKey(knownHosts, fingerprint string) {
+	s.hostKeys = NewHostKeyPinner(knownHosts, fingerprint)
+}
+
 func (s *STPClient) Login() error {
-	loginCmd := &STPLoginData{AuthKey: s.authKey, Name: s.name}
-	data, err := json.Marshal(loginCmd)
+	err := s.connect()
 	if err != nil {
 		return err
 	}
-	cmd := STPCmd{
-		CmdType: "login",
-		Data:    data,
+	// 服务端定时 ping, 超过 pongWait 没有消息认为服务端失联
+	s.conn.KeepAlive(nil)
+	// ws 转发在读循环开始前准备好, 登录响应之前服务端就可能打开 stream
+	var wsTargets *wsForward
+	if s.transport == TransportWs {
+		wsTargets = s.StartWsForward()
 	}
-	err = s.connect()
-	if err != nil {
-		return err
+	disp := NewDispatcher(s.conn)
+	s.disp = disp
+	disp.Handle("heartBeat", func(cmd *STPCmd) error {
+		return s.SendHeartBeat(disp)
+	})
+	disp.Handle("relogin", func(cmd *STPCmd) error {
+		// remote server tunnel stop, handler server relogin cmd
+		m := STPMsgData{}
+		json.Unmarshal(cmd.Data, &m)
+		s.events <- clientEvent{disp: disp, cmd: "relogin", msg: m.Msg}
+		return nil
+	})
+	disp.Handle("exec", func(cmd *STPCmd) error {
+		return s.onExec(disp, cmd)
+	})
+	for _, op := range []string{FileStat, FileRead, FileWrite, FileCommit} {
+		disp.Handle(op, func(cmd *STPCmd) error {
+			return s.onFile(disp, cmd)
+		})
 	}
-	err = s.conn.WriteJSON(cmd)
+	disp.Handle("kick", func(cmd *STPCmd) error {
+		m := STPMsgData{}
+		json.Unmarshal(cmd.Data, &m)
+		s.events <- clientEvent{disp: disp, cmd: "kick", msg: m.Msg}
+		return nil
+	})
+	disp.Handle("rateLimit", func(cmd *STPCmd) error {
+		return s.onRateLimit(cmd)
+	})
+	disp.Handle("activate", func(cmd *STPCmd) error {
+		s.events <- clientEvent{disp: disp, cmd: "activate", req: cmd}
+		return nil
+	})
+	disp.Handle("deactivate", func(cmd *STPCmd) error {
+		m := STPMsgData{}
+		json.Unmarshal(cmd.Data, &m)
+		s.events <- clientEvent{disp: disp, cmd: "deactivated", msg: m.Msg}
+		return nil
+	})
+	go func() {
+		err := disp.Run()
+		s.events <- clientEvent{disp: disp, msg: err.Error()}
+	}()
+
+	err = disp.Hello()
 	if err != nil {
 		return err
 	}
-	resp := &STPResp{}
-	err = s.conn.ReadJSON(resp)
+	if s.transport == TransportWs && !s.conn.Supports(FeatureWsTransport) {
+		return errors.New("server does not support ws transport")
+	}
+	if len(s.targets) > 1 && !s.conn.Supports(FeatureTargets) {
+		log.Println("server only forward the first target")
+	}
+	onDemand := s.onDemand && s.conn.Supports(FeatureOnDemand)
+	if s.onDemand && !onDemand {
+		log.Println("server does not support on demand tunnel")
+	}
+	loginData := &STPLoginData{AuthKey: s.authKey, Name: s.name, Targets: s.targets, Transport: s.transport, OnDemand: onDemand}
+	resp := &STPLoginResp{}
+	err = disp.Call("login", loginData, resp)
 	if err != nil {
+		log.Println(err.Error())
 		return err
 	}
-	if resp.Status != 200 {
-		log.Println(resp.ErrMsg, resp.Status)
-		return fmt.Errorf("Status: %d, ErrMsg: %s", resp.Status, resp.ErrMsg)
+	if s.conn.Supports(FeatureTraffic) {
+		go s.reportTraffic(disp)
 	}
-	sshUser, ok := resp.Data["sshUser"].(string)
-	if !ok {
-		return errors.New("invalid ssh user resp")
+	// 旧服务端不下发限速, 只使用本机的限速
+	s.setPushedRate(resp.RateLimit)
+	// old server don't report name result
+	if resp.NameResult != "" && resp.NameResult != NameAccepted {
+		log.Println("client name", s.name, resp.NameResult, "as", resp.Name)
 	}
-	sshAddr, ok := resp.Data["sshAddr"].(string)
-	if !ok {
-		return errors.New("invalid ssh addr resp")
+	if resp.PublicKey != "" {
+		err = AddAuthorizedKey(resp.PublicKey, "")
+		if err != nil {
+			log.Println("add authorized key error", err.Error())
+		}
 	}
-	assginPort, ok := resp.Data["port"].(string)
-	if !ok {
+	s.tunnel = nil
+	s.wsTargets = wsTargets
+	s.demandTunnel = resp.OnDemand
+	if resp.OnDemand {
+		log.Println("on demand tunnel, waiting for activate")
+		return nil
+	}
+	return s.startTunnel(resp, wsTargets)
+}
+
+// startTunnel 按服务端分配的端口开始转发
+func (s *STPClient) startTunnel(resp *STPLoginResp, wsTargets *wsForward) error {
+	if resp.Port == "" {
 		return errors.New("invalid port resp")
 	}
-	privateKey, ok := resp.Data["privateKey"].(string)
-	if !ok {
-		return errors.New("invalid privateKey resp")
+	targets := resp.Ports
+	if targets == nil {
+		// old server only assgin one port
+		targets = []*STPTarget{{Label: s.targets[0].Label, Addr: s.targets[0].Addr, Port: resp.Port}}
+	} else if len(targets) != len(s.targets) {
+		return errors.New("invalid ports resp")
 	}
-	publicKey, ok := resp.Data["publicKey"].(string)
-	if !ok {
-		return errors.New("invalid publicKey resp")
+	for _, target := range targets {
+		log.Println("assgin port:", target.Port, "->", target)
 	}
 
-	log.Println("ssh user:", sshUser)
-	log.Println("ssh addr:", sshAddr)
-	log.Println("assgin port:", assginPort)
-	err = AddAuthorizedKey(publicKey, "")
-	if err != nil {
-		log.Println("add authorized key error", err.Error())
+	// old server always use ssh
+	if resp.Transport == TransportWs {
+		log.Println("transport: ws")
+		wsTargets.SetTargets(targets)
+		return nil
+	}
+	if resp.SSHUser == "" || resp.SSHAddr == "" || resp.PrivateKey == "" {
+		return errors.New("invalid ssh resp")
 	}
 
-	go s.StartSSHTunnel(sshUser, sshAddr, assginPort, privateKey)
-	return nil
+	log.Println("ssh user:", resp.SSHUser)
+	log.Println("ssh addr:", resp.SSHAddr)
+	return s.StartSSHTunnel(resp.SSHUser, resp.SSHAddr, targets, resp.PrivateKey, resp.HostKeys)
 }
 
-func (s *STPClient) StartSSHTunnel(sshUser string, sshAddr string, assginPort string, privateKey string) {
-	local := &Endpoint{
-		"localhost",
-		s.localPort,
-	}
+// StartSSHTunnel 在后台运行 ssh 隧道, ssh 连接断开时关闭控制连接触发重新登录, 按需隧道只关闭隧道
+func (s *STPClient) StartSSHTunnel(sshUser string, sshAddr string, targets []*STPTarget, privateKey string, hostKeys []string) error {
 	items := strings.Split(sshAddr, ":")
 	server := &Endpoint{
 		items[0],
 		items[1],
 	}
-	remote := &Endpoint{
-		"0.0.0.0",
-		assginPort,
+	forwards := []*SSHForward{}
+	for _, target := range targets {
+		host, port, err := net.SplitHostPort(target.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid forward target %s", target.Addr)
+		}
+		forwards = append(forwards, &SSHForward{
+			Local:  &Endpoint{host, port},
+			Remote: &Endpoint{"0.0.0.0", target.Port},
+			limit:  s.tunnelLimiter(target.Key()),
+		})
 	}
 	authMethod, err := privateKeyAuthMethod(privateKey)
 	if err != nil {
 		log.Println("ssh load private auth key error", err.Error())
-		return
+		return err
 	}
 	sshConfig := &ssh.ClientConfig{
 		User: sshUser,
 		Auth: []ssh.AuthMethod{
 			authMethod,
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: s.hostKeys.Callback(sshAddr, hostKeys),
 	}
 
-	s.tunnel = &SSHtunnel{
-		Local:    local,
+	tunnel := &SSHtunnel{
 		Server:   server,
-		Remote:   remote,
+		Forwards: forwards,
 		Config:   sshConfig,
 		StopConn: make(chan bool),
+		conns:    s.conns,
+		traffic:  s.traffic,
+		limiter:  s.limiter,
 	}
+	s.tunnel = tunnel
 
-	// block
-	err = s.tunnel.Start()
-	if err != nil {
-		log.Println("start ssh tunnel error", err.Error())
+	conn := s.conn
+	disp := s.disp
+	onDemand := s.demandTunnel
+	go func() {
+		// block
+		err := tunnel.Start()
+		if err != nil {
+			log.Println("ssh tunnel error", err.Error())
+			if onDemand {
+				s.events <- clientEvent{disp: disp, cmd: "deactivate", msg: err.Error()}
+			} else {
+				conn.Close()
+			}
+		}
+		log.Println("tunnel end")
+	}()
+	return nil
+}
+
+// wsForward ws 转发的端口和本地目标
+type wsForward struct {
+	lock    sync.Mutex
+	targets map[string]*STPTarget
+}
+
+// SetTargets 登录成功后设置转发目标, 之前打开的 stream 会被拒绝
+func (f *wsForward) SetTargets(targets []*STPTarget) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, target := range targets {
+		f.targets[target.Port] = target
 	}
-	log.Println("tunnel end")
-	return
+}
+
+func (f *wsForward) lookup(port string) (*STPTarget, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	target, ok := f.targets[port]
+	return target, ok
+}
+
+// StartWsForward 在控制连接上接收服务端打开的 stream, 转发到对应的本地目标
+func (s *STPClient) StartWsForward() *wsForward {
+	forward := &wsForward{targets: make(map[string]*STPTarget)}
+	NewWsMux(s.conn, func(stream *WsStream, port string) {
+		target, ok := forward.lookup(port)
+		if !ok {
+			log.Println("unknown ws forward port", port)
+			stream.Close()
+			return
+		}
+		local, err := net.Dial("tcp", target.Addr)
+		if err != nil {
+			log.Printf("Dial INTO local service %s error: %s", target.Addr, err)
+			stream.Close()
+			return
+		}
+		s.conns.add()
+		defer s.conns.done()
+		handleClient(stream, local, s.traffic.open(stream.RemoteAddr().String(), target.Addr), s.limiter, s.tunnelLimiter(target.Key()))
+	})
+	return forward
 }
 
 func (s *STPClient) connect() error {
 	if s.conn != nil {
 		s.conn.Close()
 	}
-	wsconn, _, err := websocket.DefaultDialer.Dial(s.serverUrl, nil)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = s.tlsConfig
+	wsconn, _, err := dialer.Dial(s.serverUrl, nil)
 	if err != nil {
 		return err
 	}
-	s.conn = wsconn
+	s.conn = NewControlConn(wsconn)
 	return nil
 }
 
-func (s *STPClient) Daemon() {
-	for {
-		cmd := &STPCmd{}
-		err := s.conn.ReadJSON(cmd)
-		if err != nil {
-			if _, ok := err.(*websocket.CloseError); ok {
-				s.Relogin()
-				continue
-			} else {
-				log.Println("deamon", err.Error())
-			}
+// Daemon 处理服务端命令, 断线后自动重新登录, 被服务端踢下线时返回
+func (s *STPClient) Daemon() error {
+	for event := range s.events {
+		if event.disp != s.disp {
+			// 旧连接
+			continue
 		}
-		// handler cmd
-		switch cmd.CmdType {
-		case "heartBeat":
-			s.SendHeartBeat(s.conn)
+		switch event.cmd {
+		case "":
+			// 连接关闭、读超时或 ssh 隧道断开
+			log.Println("deamon", event.msg)
+			s.Relogin()
 		case "relogin":
-			// remote server tunnel stop, handler server relogin cmd
-			m := make(map[string]interface{})
-			err := json.Unmarshal(cmd.Data, &m)
-			msg := ""
-			if err != nil {
-				msg, _ = m["msg"].(string)
-			}
-			log.Println("recived the relogin cmd, msg", msg)
+			log.Println("recived the relogin cmd, msg", event.msg)
 			s.Relogin()
-			continue
+		case "activate":
+			s.activate(event.disp, event.req)
+		case "deactivate":
+			// 空闲超时或 ssh 隧道断开
+			s.deactivate(event.disp, event.msg, true)
+		case "deactivated":
+			s.deactivate(event.disp, event.msg, false)
+		case "kick":
+			s.stopTunnel()
+			s.conn.Close()
+			return fmt.Errorf("kicked by server: %s", event.msg)
 		}
 	}
+	return nil
 }
 
 func (s *STPClient) Relogin() {
 	log.Println("relogin")
-	if s.tunnel != nil {
-		s.tunnel.Stop()
-	}
+	s.stopTunnel()
 	for {
 		err := s.Login()
 		if err == nil {
@@ -213,76 +445,445 @@ func (s *STPClient) Relogin() {
 	}
 }
 
-func (s *STPClient) SendHeartBeat(c *websocket.Conn) error {
-	hb := STPHBData{
-		Msg: "Ping",
-	}
-	hbdata, _ := json.Marshal(hb)
-	cmd := STPCmd{
-		CmdType: "heartBeat",
-		Data:    hbdata,
-	}
-	return c.WriteJSON(cmd)
+func (s *STPClient) SendHeartBeat(disp *Dispatcher) error {
+	return disp.Send("heartBeat", STPHBData{Msg: "Ping"})
 }
 
 type Client struct {
-	Name       string `json:"name"`
-	Port       string `json:"port"`
-	Addr       string `json:"addr"`
-	LoginTime  int64  `json:"loginTime"`
-	OnlineTime int64  `json:"onlineTime"`
-	IsOnline   bool   `json:"isOnline"`
-	conn       *websocket.Conn
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	Port       string       `json:"port"`
+	Targets    []*STPTarget `json:"targets"`
+	Transport  string       `json:"transport"`
+	Addr       string       `json:"addr"`
+	LoginTime  int64        `json:"loginTime"`
+	OnlineTime int64        `json:"onlineTime"`
+	IsOnline   bool         `json:"isOnline"`
+	LastSeen   int64        `json:"lastSeen"`
+	OnDemand   bool         `json:"onDemand"`
+	Active     bool         `json:"active"`            // 隧道已经打开, 按需客户端空闲时为 false
+	Traffic    *STPTraffic  `json:"traffic,omitempty"` // stpcli 最后一次上报的流量
+	conn       *ControlConn
+	disp       *Dispatcher
+	// tunnelLock 保护 cred, listeners, activating 和按需隧道的打开关闭, 不能在持有时等待客户端
+	// Port, Targets, Active 同时持有 tunnelLock 和 ClientManager 的锁时修改
+	tunnelLock sync.Mutex
+	cred       *TunnelCredential
+	listeners  []net.Listener // ws 转发时服务端监听的端口
+	activating chan struct{}  // 正在等待客户端响应 activate, 完成或隧道关闭时 close
+	portStart  int
+	portEnd    int
+}
+
+// snapshot 复制导出的字段, 需要持有 ClientManager 的锁
+func (cli *Client) snapshot() *Client {
+	return &Client{
+		ID:         cli.ID,
+		Name:       cli.Name,
+		Port:       cli.Port,
+		Targets:    cli.Targets,
+		Transport:  cli.Transport,
+		Addr:       cli.Addr,
+		LoginTime:  cli.LoginTime,
+		OnlineTime: cli.OnlineTime,
+		IsOnline:   cli.IsOnline,
+		LastSeen:   cli.LastSeen,
+		OnDemand:   cli.OnDemand,
+		Active:     cli.Active,
+		Traffic:    cli.Traffic,
+	}
 }
 
+// ClientManager 管理在线会话和客户端注册信息, 所有方法都可以并发调用
+// 会话按 id 索引, id 跟随客户端名保存在注册信息中, 重新登录和 stpsrv 重启后不变
+// IsOnline, LastSeen, OnlineTime 只在持有锁时修改, 读取请用 List 返回的快照
 type ClientManager struct {
-	clients []*Client
+	clients map[string]*Client // 在线会话, id -> client
+	order   []string           // 在线会话的登录顺序
+	records map[string]*ClientRecord
+	pending map[string]bool // 正在登录的客户端名, AddClient 或 ReleaseName 后删除
+	store   ClientStore
+	dirty   bool // Touch, SetTraffic 修改了注册信息, 还没有保存
 	lock    sync.Mutex
 }
 
 func NewClientManager() *ClientManager {
-	return &ClientManager{clients: []*Client{}}
+	return &ClientManager{clients: make(map[string]*Client), records: make(map[string]*ClientRecord), pending: make(map[string]bool)}
 }
 
+// newClientID 生成 8 位十六进制 id
+func newClientID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// UseStore 从 store 加载客户端注册信息, 之后的变化都会保存到 store
+func (cm *ClientManager) UseStore(store ClientStore) error {
+	records, err := store.Load()
+	if err != nil {
+		return err
+	}
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	// 旧版本的状态文件没有 id
+	for _, record := range records {
+		if record.ID == "" {
+			record.ID = newClientID()
+		}
+	}
+	cm.store = store
+	cm.records = records
+	return nil
+}
+
+// AddClient 添加在线会话并设置 cli.ID, 同名客户端已经在线时 id 加序号区分
 func (cm *ClientManager) AddClient(cli *Client) {
+	cm.lock.Lock()
+	id := newClientID()
+	if record, ok := cm.records[cli.Name]; ok && record.ID != "" {
+		id = record.ID
+	}
+	cli.ID = id
+	for n := 2; cm.clients[cli.ID] != nil; n++ {
+		cli.ID = fmt.Sprintf("%s-%d", id, n)
+	}
+	cli.IsOnline = true
+	delete(cm.pending, cli.Name)
+	cm.clients[cli.ID] = cli
+	cm.order = append(cm.order, cli.ID)
+	record := &ClientRecord{
+		ID:        id,
+		Name:      cli.Name,
+		Port:      cli.Port,
+		Targets:   cli.Targets,
+		Addr:      cli.Addr,
+		LoginTime: cli.LoginTime,
+		LastSeen:  cli.LoginTime,
+	}
+	// 按需隧道登录时没有分配端口, 保留上次的端口, 打开隧道时优先使用
+	if old, ok := cm.records[cli.Name]; ok && cli.Port == "" {
+		record.Port, record.Targets = old.Port, old.Targets
+	}
+	// 收到新的上报之前显示上次的流量
+	if old, ok := cm.records[cli.Name]; ok {
+		record.Traffic = old.Traffic
+		cli.Traffic = old.Traffic
+	}
+	cm.records[cli.Name] = record
+	cm.lock.Unlock()
+	cm.Persist()
+}
+
+// ReserveName 按 policy 处理同名客户端, 占用实际使用的名字, 正在登录的名字也算在线
+// 返回 replace 时需要踢下线的同名会话; 登录成功后由 AddClient 释放占用, 失败时调用 ReleaseName
+func (cm *ClientManager) ReserveName(name, policy string) (string, string, []*Client, error) {
 	cm.lock.Lock()
 	defer cm.lock.Unlock()
-	cm.clients = append(cm.clients, cli)
+	online := make(map[string][]*Client)
+	for _, id := range cm.order {
+		cli := cm.clients[id]
+		online[cli.Name] = append(online[cli.Name], cli)
+	}
+	taken := func(name string) bool {
+		return len(online[name]) > 0 || cm.pending[name]
+	}
+	if !taken(name) {
+		cm.pending[name] = true
+		return name, NameAccepted, nil, nil
+	}
+	switch policy {
+	case DupNameReplace:
+		// 同名客户端正在登录时不能替换, 否则两个登录都会成功
+		if !cm.pending[name] {
+			cm.pending[name] = true
+			return name, NameReplaced, online[name], nil
+		}
+	case DupNameSuffix:
+		for n := 2; ; n++ {
+			suffixed := suffixName(name, n)
+			if !taken(suffixed) {
+				cm.pending[suffixed] = true
+				return suffixed, NameSuffixed, nil, nil
+			}
+		}
+	}
+	return "", "", nil, fmt.Errorf("client name %s already online", name)
+}
+
+// ReleaseName 登录失败, 释放 ReserveName 占用的名字
+func (cm *ClientManager) ReleaseName(name string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	delete(cm.pending, name)
+}
+
+// SetTunnel 更新按需隧道的端口, active 为 false 时端口已经回收
+func (cm *ClientManager) SetTunnel(cli *Client, targets []*STPTarget, active bool) {
+	cm.lock.Lock()
+	cli.Targets = targets
+	cli.Port = ""
+	if len(targets) > 0 {
+		cli.Port = targets[0].Port
+	}
+	cli.Active = active
+	record, ok := cm.records[cli.Name]
+	if !active || !ok || cm.clients[cli.ID] != cli {
+		cm.lock.Unlock()
+		return
+	}
+	record.Port, record.Targets = cli.Port, targets
+	cm.lock.Unlock()
+	cm.Persist()
+}
+
+// SetTraffic 保存客户端上报的流量
+func (cm *ClientManager) SetTraffic(cli *Client, traffic *STPTraffic) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.clients[cli.ID] != cli {
+		return
+	}
+	cli.Traffic = traffic
+	if record, ok := cm.records[cli.Name]; ok {
+		record.Traffic = traffic
+		cm.dirty = true
+	}
+}
+
+// Touch 更新客户端最后在线时间
+func (cm *ClientManager) Touch(cli *Client) {
+	now := time.Now().Unix()
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.clients[cli.ID] != cli || cli.LastSeen == now {
+		return
+	}
+	cli.LastSeen = now
+	cli.OnlineTime = now - cli.LoginTime
+	if record, ok := cm.records[cli.Name]; ok {
+		record.LastSeen = now
+		cm.dirty = true
+	}
 }
 
-func (cm *ClientManager) DelClientByIdx(idx int) {
+// LastTargets 返回客户端上次的转发目标和分配的端口
+func (cm *ClientManager) LastTargets(name string) []*STPTarget {
 	cm.lock.Lock()
 	defer cm.lock.Unlock()
-	if idx >= len(cm.clients) || len(cm.clients) == 0 {
+	record, ok := cm.records[name]
+	if !ok {
+		return nil
+	}
+	if len(record.Targets) == 0 && record.Port != "" {
+		return []*STPTarget{{Port: record.Port}}
+	}
+	return record.Targets
+}
+
+// ForgetPort 从离线客户端的记录中删除端口, 重新登录时不再优先使用
+func (cm *ClientManager) ForgetPort(port string) {
+	cm.lock.Lock()
+	online := make(map[string]bool)
+	for _, cli := range cm.clients {
+		online[cli.Name] = true
+	}
+	for name, record := range cm.records {
+		if online[name] {
+			continue
+		}
+		targets := []*STPTarget{}
+		for _, target := range record.Targets {
+			t := *target
+			if t.Port == port {
+				t.Port = ""
+			}
+			targets = append(targets, &t)
+		}
+		record.Targets = targets
+		if record.Port == port {
+			record.Port = ""
+		}
+	}
+	cm.lock.Unlock()
+	cm.Persist()
+}
+
+// Persist 保存客户端注册信息
+func (cm *ClientManager) Persist() {
+	cm.lock.Lock()
+	if cm.store == nil {
+		cm.lock.Unlock()
 		return
 	}
-	lastIdx := len(cm.clients) - 1
-	cm.clients[idx] = cm.clients[lastIdx]
-	cm.clients[lastIdx] = nil
-	cm.clients = cm.clients[:lastIdx]
+	records := make(map[string]*ClientRecord, len(cm.records))
+	for name, record := range cm.records {
+		r := *record
+		records[name] = &r
+	}
+	store := cm.store
+	cm.dirty = false
+	cm.lock.Unlock()
+	err := store.Save(records)
+	if err != nil {
+		log.Println("save client records error", err.Error())
+	}
+}
+
+// PersistDirty 注册信息在上次保存后有变化时才保存
+func (cm *ClientManager) PersistDirty() {
+	cm.lock.Lock()
+	dirty := cm.dirty
+	cm.lock.Unlock()
+	if dirty {
+		cm.Persist()
+	}
+}
+
+// List 返回在线会话和离线客户端的快照, 在线会话按登录顺序, 离线客户端排在后面
+func (cm *ClientManager) List() []*Client {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	list := []*Client{}
+	online := make(map[string]bool)
+	for _, id := range cm.order {
+		cli := cm.clients[id].snapshot()
+		list = append(list, cli)
+		online[cli.Name] = true
+	}
+	offline := []*Client{}
+	for name, record := range cm.records {
+		if online[name] {
+			continue
+		}
+		offline = append(offline, &Client{
+			ID:        record.ID,
+			Name:      record.Name,
+			Port:      record.Port,
+			Targets:   record.Targets,
+			Addr:      record.Addr,
+			LoginTime: record.LoginTime,
+			LastSeen:  record.LastSeen,
+			Traffic:   record.Traffic,
+		})
+	}
+	sort.Slice(offline, func(i, j int) bool { return offline[i].LastSeen > offline[j].LastSeen })
+	return append(list, offline...)
+}
+
+// Sessions 返回在线会话的指针, 按登录顺序
+// 不加锁只能读取 AddClient 之后不再修改的 ID, Name, Transport, Addr, LoginTime, OnDemand, conn, disp,
+// 其他字段用 Snapshot 或 List 读取
+func (cm *ClientManager) Sessions() []*Client {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	sessions := make([]*Client, 0, len(cm.order))
+	for _, id := range cm.order {
+		sessions = append(sessions, cm.clients[id])
+	}
+	return sessions
+}
+
+// Snapshot 返回在线会话的快照, 会话已经下线时返回 nil
+func (cm *ClientManager) Snapshot(cli *Client) *Client {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.clients[cli.ID] != cli {
+		return nil
+	}
+	return cli.snapshot()
+}
+
+// Get 按 id 查找在线会话
+func (cm *ClientManager) Get(id string) *Client {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	return cm.clients[id]
+}
+
+// DelClient 删除在线会话, 会话已经删除时返回 false
+func (cm *ClientManager) DelClient(cli *Client) bool {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.clients[cli.ID] != cli {
+		return false
+	}
+	delete(cm.clients, cli.ID)
+	for idx, id := range cm.order {
+		if id == cli.ID {
+			cm.order = append(cm.order[:idx], cm.order[idx+1:]...)
+			break
+		}
+	}
+	cli.IsOnline = false
+	return true
+}
+
+// FindClient 按 id 或名字查找客户端, 先匹配 id, 同名客户端有多个时返回错误
+func FindClient(clients []*Client, key string) (*Client, error) {
+	matched := []*Client{}
+	for _, client := range clients {
+		if client.ID == key {
+			return client, nil
+		}
+		if client.Name == key {
+			matched = append(matched, client)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("client %s not found", key)
+	}
+	if len(matched) > 1 {
+		ids := []string{}
+		for _, client := range matched {
+			ids = append(ids, client.ID)
+		}
+		return nil, fmt.Errorf("client name %s is ambiguous, use id: %s", key, strings.Join(ids, ", "))
+	}
+	return matched[0], nil
 }
 
 type STPServer struct {
 	authKey    string
 	listenAddr string
-	privateKey string
 	publicKey  string
 	sshUser    string
 	sshAddr    string
 	portMgr    *PortManager
 	cliMgr     *ClientManager
+	tokens     *TokenStore
+	hostKeys   []string
+	tlsConfig  *tls.Config
+	authorizer TunnelAuthorizer
+
+	// cfgLock 保护可以重新加载的配置
+	cfgLock          sync.RWMutex
+	pinPorts         map[string]int
+	probeInterval    time.Duration
+	probeConcurrency int
+	probeRate        int
+	dupNamePolicy    string
+	idleTimeout      time.Duration
+	apiTokens        []string
+	onReload         func() error
+	adminListen      string
+	adminSocket      string
+	rateLimits       map[string]*STPRateLimit
+
+	execLock sync.Mutex
+	execs    map[string]*execSession
+
+	// credLock 保护 creds, ssh 连接断开时按凭证找到客户端
+	credLock sync.Mutex
+	creds    map[*TunnelCredential]*Client
+
+	metrics *serverMetrics
 }
 
-func NewSTPServer(authKey, listenAddr, sshAddr, privateKey, publicKey, sshUser, portRange string) *STPServer {
-	startEnd := strings.Split(portRange, "-")
-	if len(startEnd) != 2 {
-		log.Fatalln("invalid port range,", portRange)
-	}
-	startInt, err := strconv.Atoi(startEnd[0])
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
-	endInt, err := strconv.Atoi(startEnd[1])
+func NewSTPServer(authKey, listenAddr, sshAddr, publicKey, sshUser, portRange string) *STPServer {
+	startInt, endInt, err := ParsePortRange(portRange)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
@@ -290,62 +891,276 @@ func NewSTPServer(authKey, listenAddr, sshAddr, privateKey, publicKey, sshUser,
 	cliMgr := NewClientManager()
 
 	return &STPServer{
-		authKey:    authKey,
-		listenAddr: listenAddr,
-		portMgr:    portMgr,
-		privateKey: privateKey,
-		publicKey:  publicKey,
-		sshUser:    sshUser,
-		sshAddr:    sshAddr,
-		cliMgr:     cliMgr,
+		authKey:       authKey,
+		listenAddr:    listenAddr,
+		portMgr:       portMgr,
+		publicKey:     publicKey,
+		sshUser:       sshUser,
+		sshAddr:       sshAddr,
+		cliMgr:        cliMgr,
+		authorizer:    &AuthorizedKeysAuthorizer{User: sshUser},
+		dupNamePolicy: DupNameReject,
+		idleTimeout:   defaultIdleTimeout,
+		execs:         make(map[string]*execSession),
+		creds:         make(map[*TunnelCredential]*Client),
+		metrics:       newServerMetrics(),
+	}
+}
+
+// UseTokenStore 使用按客户端名签发的 token 登录，不再接受全局 authKey
+func (s *STPServer) UseTokenStore(tokens *TokenStore) {
+	s.tokens = tokens
+}
+
+// UseClientStore 持久化客户端注册信息, 重启后保留离线客户端和上次分配的端口
+func (s *STPServer) UseClientStore(store ClientStore) error {
+	return s.cliMgr.UseStore(store)
+}
+
+// PinPorts 把端口固定给指定客户端, 重新加载时取消之前的固定
+func (s *STPServer) PinPorts(pinned map[string]int) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	s.pinPorts = pinned
+	s.portMgr.ClearReserved()
+	for name, port := range pinned {
+		if !s.portMgr.Reserve(port, name) {
+			log.Printf("pinned port %d of %s out of range\n", port, name)
+		}
+	}
+}
+
+// AnnounceHostKeys 登录时下发 sshd host key 指纹, 客户端用来校验 ssh 连接
+func (s *STPServer) AnnounceHostKeys(fingerprints []string) {
+	s.hostKeys = fingerprints
+}
+
+// UseSSHServer 使用内置 ssh 服务代替系统 sshd, ssh 连接断开时客户端立即下线
+func (s *STPServer) UseSSHServer(ss *SSHServer) {
+	s.authorizer = ss
+	s.hostKeys = []string{ss.HostKeyFingerprint()}
+	ss.OnDisconnect(func(cred *TunnelCredential) {
+		client := s.credClient(cred)
+		if client == nil {
+			return
+		}
+		// 按需客户端只关闭隧道, 控制连接保持在线
+		if client.OnDemand {
+			if s.deactivate(client, "ssh tunnel closed") {
+				s.SendDeactivate(client.disp, "ssh tunnel closed")
+			}
+			return
+		}
+		s.setOffline(client, "ssh tunnel closed", true)
+	})
+	ss.OnForward(func(cred *TunnelCredential, conn net.Conn) net.Conn {
+		return s.metrics.countConn(cred.Client, conn)
+	})
+}
+
+// UseTLS 控制通道使用 wss
+func (s *STPServer) UseTLS(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// DupNamePolicy 设置同名客户端已经在线时的处理方式 DupNameReject, DupNameReplace 或 DupNameSuffix
+func (s *STPServer) DupNamePolicy(policy string) error {
+	err := ValidDupNamePolicy(policy)
+	if err != nil {
+		return err
+	}
+	s.cfgLock.Lock()
+	s.dupNamePolicy = policy
+	s.cfgLock.Unlock()
+	return nil
+}
+
+// EnablePortProbe 每隔 interval 探测一次转发端口, 最多 concurrency 个并发, 每秒最多 rate 个
+// 在线状态由控制连接的 ping/pong 和 ssh 连接断开判断, 端口探测只用于发现本地服务不可达的客户端
+func (s *STPServer) EnablePortProbe(interval time.Duration, concurrency, rate int) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	s.probeInterval = interval
+	s.probeConcurrency = concurrency
+	s.probeRate = rate
+}
+
+// AdminListen 管理接口单独监听 addr, 控制端口只接受客户端连接
+func (s *STPServer) AdminListen(addr string) {
+	s.adminListen = addr
+}
+
+// AdminSocket 管理接口同时监听 unix socket, 只有 socket 文件的属主和属组可以访问, 不需要 token
+func (s *STPServer) AdminSocket(path string) {
+	s.adminSocket = path
+}
+
+// handleAdmin 注册管理接口, 需要 token 或本机访问, public 为 true 时只接受 token
+func (s *STPServer) handleAdmin(mux *http.ServeMux, public bool) {
+	mux.HandleFunc("/showClient", s.adminOnly(s.ShowClientHandler, public))
+	mux.HandleFunc("/exec", s.adminOnly(s.ExecHandler, public))
+	mux.HandleFunc("/file", s.adminOnly(s.FileHandler, public))
+	mux.HandleFunc("/activate", s.adminOnly(s.ActivateHandler, public))
+	mux.HandleFunc("/api/v1/", s.APIHandler)
+	mux.HandleFunc("/metrics", s.adminOnly(s.MetricsHandler, public))
+}
+
+// listenAdminSocket unix socket 上的管理接口由文件权限控制访问
+func (s *STPServer) listenAdminSocket() (net.Listener, error) {
+	if conn, err := net.Dial("unix", s.adminSocket); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("admin socket %s in use", s.adminSocket)
+	}
+	// 上次退出时留下的 socket 文件
+	os.Remove(s.adminSocket)
+	listener, err := net.Listen("unix", s.adminSocket)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(s.adminSocket, 0660)
+	if err != nil {
+		listener.Close()
+		return nil, err
 	}
+	return listener, nil
 }
 
 func (s *STPServer) Start() {
+	if aa, ok := s.authorizer.(*AuthorizedKeysAuthorizer); ok {
+		err := aa.Purge()
+		if err != nil {
+			log.Println("remove stale tunnel keys error", err.Error())
+		}
+	}
 	go s.checker()
-	http.HandleFunc("/", s.WsHandler)
-	http.HandleFunc("/showClient", s.ShowClientHandler)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.WsHandler)
+	if s.adminListen != "" {
+		admin := http.NewServeMux()
+		s.handleAdmin(admin, false)
+		go func() {
+			log.Println("admin listen on", s.adminListen)
+			log.Fatal(http.ListenAndServe(s.adminListen, admin))
+		}()
+	} else {
+		s.handleAdmin(mux, true)
+	}
+	if s.adminSocket != "" {
+		listener, err := s.listenAdminSocket()
+		if err != nil {
+			log.Fatalln("admin socket error", err.Error())
+		}
+		local := http.NewServeMux()
+		local.HandleFunc("/showClient", s.ShowClientHandler)
+		local.HandleFunc("/exec", s.ExecHandler)
+		local.HandleFunc("/file", s.FileHandler)
+		local.HandleFunc("/activate", s.ActivateHandler)
+		local.HandleFunc("/api/v1/", s.serveAPI)
+		local.HandleFunc("/metrics", s.MetricsHandler)
+		go func() {
+			log.Println("admin socket on", s.adminSocket)
+			log.Fatal(http.Serve(listener, local))
+		}()
+	}
+	server := &http.Server{Addr: s.listenAddr, Handler: mux, TLSConfig: s.tlsConfig}
+	if s.tlsConfig != nil {
+		log.Println("listen on", s.listenAddr, "with tls")
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Println("listen on", s.listenAddr)
-	log.Fatal(http.ListenAndServe(s.listenAddr, nil))
+	log.Fatal(server.ListenAndServe())
 }
 
 func (s *STPServer) checker() {
+	lastProbe := time.Now()
 	for {
 		time.Sleep(10 * time.Second)
-		offlineIdxs := []int{}
-		for idx, client := range s.cliMgr.clients {
-			if client == nil {
-				continue
-			}
-			port, err := strconv.Atoi(client.Port)
-			if err != nil {
-				continue
-			}
-			if online, err := s.portMgr.PingPort(port); !online {
-				log.Printf("[check] %d port %s offline, err %s", idx, client.Port, err.Error())
-				client.IsOnline = false
-				s.portMgr.ReleasePort(client.Port)
-				s.SendRelogin(client.conn, fmt.Sprintf("check port %s offline", client.Port))
-				offlineIdxs = append(offlineIdxs, idx)
-				continue
-			} else {
-				client.IsOnline = true
-				client.OnlineTime = time.Now().Unix() - client.LoginTime
-			}
-			s.SendHeartBeat(client.conn)
+		s.cfgLock.RLock()
+		interval := s.probeInterval
+		s.cfgLock.RUnlock()
+		if interval > 0 && time.Since(lastProbe) >= interval {
+			s.probePorts()
+			lastProbe = time.Now()
 		}
+		s.cliMgr.PersistDirty()
+	}
+}
 
-		// must iterate it backwards
-		for idx := len(offlineIdxs) - 1; idx >= 0; idx-- {
-			s.cliMgr.DelClientByIdx(offlineIdxs[idx])
+// probePorts 并发探测 ssh 转发的端口, 不通的客户端下线并通知重新登录
+// ws 转发的端口由服务端自己监听, 按需隧道空闲时会关闭, 都不需要探测
+func (s *STPServer) probePorts() {
+	start := time.Now()
+	s.cfgLock.RLock()
+	rate, concurrency := s.probeRate, s.probeConcurrency
+	s.cfgLock.RUnlock()
+	var limit <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	clients := s.cliMgr.Sessions()
+	for _, client := range clients {
+		if client.Transport == TransportWs || client.OnDemand {
+			continue
+		}
+		snapshot := s.cliMgr.Snapshot(client)
+		if snapshot == nil {
+			continue
 		}
+		port, err := strconv.Atoi(snapshot.Port)
+		if err != nil {
+			continue
+		}
+		if limit != nil {
+			<-limit
+		}
+		sem <- true
+		wg.Add(1)
+		go func(client *Client, port int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if online, err := s.portMgr.PingPort(port); !online {
+				log.Printf("[check] %s port %d offline, err %s", client.Name, port, err.Error())
+				s.metrics.relogin()
+				s.setOffline(client, fmt.Sprintf("check port %d offline", port), true)
+			}
+		}(client, port)
+	}
+	wg.Wait()
+	s.metrics.sweep(time.Since(start))
+	log.Printf("[check] probe %d clients in %s", len(clients), time.Since(start))
+}
+
+// setOffline 会话下线, 回收端口和凭证, relogin 为 true 时通知客户端重新登录
+// 控制连接断开、ssh 连接断开和端口探测可能同时发现下线, 只处理一次
+func (s *STPServer) setOffline(client *Client, reason string, relogin bool) {
+	if !s.cliMgr.DelClient(client) {
+		return
+	}
+	client.tunnelLock.Lock()
+	log.Println("client offline:", client.Name, client.Port, reason)
+	s.closeTunnel(client)
+	client.tunnelLock.Unlock()
+	if relogin {
+		s.SendRelogin(client.disp, reason)
 	}
+	s.cliMgr.Persist()
 }
 
+// STPResp 命令响应, data 为对应命令的响应结构, 如 STPLoginResp
 type STPResp struct {
-	Status int                    `json:"status"`
-	ErrMsg string                 `json:"errMsg"`
-	Data   map[string]interface{} `json:"data"`
+	ID     uint64          `json:"id,omitempty"`
+	Status int             `json:"status"`
+	ErrMsg string          `json:"errMsg"`
+	Data   json.RawMessage `json:"data"`
 }
 
 func NewBadRequestError(msg string) STPResp {
@@ -358,117 +1173,400 @@ func NewBadRequestError(msg string) STPResp {
 
 func (s *STPServer) ShowClientHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.cliMgr.clients)
+	json.NewEncoder(w).Encode(s.cliMgr.List())
 }
 
 var upgrader = websocket.Upgrader{}
 
 func (s *STPServer) WsHandler(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	if s.tlsConfig != nil && s.tlsConfig.ClientCAs != nil && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		log.Println("client certificate required:", r.RemoteAddr)
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	wsconn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err.Error())
 		return
 	}
+	c := NewControlConn(wsconn)
+	s.metrics.connect(1)
+	sessions := []*Client{}
 	defer func() {
+		s.metrics.connect(-1)
 		log.Println("client disconnect:", c.RemoteAddr().String())
+		for _, client := range sessions {
+			s.setOffline(client, "control connection closed", false)
+		}
 		c.Close()
 	}()
 	log.Println("client connect:", c.RemoteAddr().String())
+	// 收到任何消息都算在线, 超过 pongWait 没有消息 ReadJSON 返回错误
+	c.KeepAlive(func() {
+		for _, client := range sessions {
+			s.cliMgr.Touch(client)
+		}
+	})
+	go c.Ping()
 
-	for {
-		cmd := STPCmd{}
-		err := c.ReadJSON(&cmd)
-		if err != nil {
-			c.WriteJSON(NewBadRequestError(err.Error()))
-			return
+	d := NewDispatcher(c)
+	d.Handle("hello", func(cmd *STPCmd) error {
+		if c.peerVersion != 0 || len(sessions) > 0 {
+			return errors.New("hello must be the first cmd")
 		}
-		switch cmd.CmdType {
-		case "login":
-			log.Println("on login")
-			client, err := s.OnLogin(c, cmd.Data)
-			if err != nil {
-				log.Println("onlogin error:", err.Error())
-				c.WriteJSON(NewBadRequestError(err.Error()))
-			} else {
-				s.cliMgr.AddClient(client)
-			}
-		case "heartBeat":
-			// do nothing
-		default:
-			c.WriteJSON(NewBadRequestError("Unknow CMD"))
+		return d.onHello(cmd)
+	})
+	d.Handle("login", func(cmd *STPCmd) error {
+		log.Println("on login")
+		client, err := s.OnLogin(d, cmd)
+		if err != nil {
+			return err
 		}
-	}
+		s.cliMgr.AddClient(client)
+		sessions = append(sessions, client)
+		return nil
+	})
+	d.Handle("deactivate", func(cmd *STPCmd) error {
+		return s.onDeactivate(d, cmd, sessions)
+	})
+	d.Handle("traffic", func(cmd *STPCmd) error {
+		return s.onTraffic(cmd, sessions)
+	})
+	d.Handle("execOutput", func(cmd *STPCmd) error {
+		return s.onExecOutput(d, cmd)
+	})
+	d.Handle("heartBeat", func(cmd *STPCmd) error {
+		// do nothing
+		return nil
+	})
+	d.Run()
+}
+
+func (s *STPServer) SendRelogin(d *Dispatcher, msg string) error {
+	return d.Send("relogin", STPMsgData{Msg: msg})
+}
+
+// SendKick 通知客户端被踢下线, 客户端收到后不再重新登录
+func (s *STPServer) SendKick(d *Dispatcher, msg string) error {
+	return d.Send("kick", STPMsgData{Msg: msg})
 }
 
-func (s *STPServer) SendHeartBeat(c *websocket.Conn) error {
-	hb := STPHBData{
-		Msg: "Ping",
+// kick 下线客户端并关闭控制连接
+func (s *STPServer) kick(client *Client, c *ControlConn, reason string) {
+	s.setOffline(client, reason, false)
+	// 旧客户端不认识 kick, 只能断开连接
+	if client.conn.Supports(FeatureKick) {
+		s.SendKick(client.disp, reason)
 	}
-	hbdata, _ := json.Marshal(hb)
-	cmd := STPCmd{
-		CmdType: "heartBeat",
-		Data:    hbdata,
+	// 同一个连接上重复登录时只下线旧会话
+	if client.conn != c {
+		client.conn.Close()
 	}
-	return c.WriteJSON(cmd)
 }
 
-func (s *STPServer) SendRelogin(c *websocket.Conn, msg string) error {
-	m := make(map[string]interface{})
-	m["msg"] = msg
-	data, _ := json.Marshal(m)
-	cmd := STPCmd{
-		CmdType: "relogin",
-		Data:    data,
+// resolveName 按 dupNamePolicy 处理已经在线的同名客户端, 返回实际使用的名字和处理方式
+// 名字在 ClientManager 中占用到登录结束, 同时登录的同名客户端不会都成功
+func (s *STPServer) resolveName(c *ControlConn, name string) (string, string, error) {
+	s.cfgLock.RLock()
+	policy := s.dupNamePolicy
+	s.cfgLock.RUnlock()
+	name, result, replaced, err := s.cliMgr.ReserveName(name, policy)
+	if err != nil {
+		return "", "", err
+	}
+	for _, client := range replaced {
+		log.Println("kick client:", client.Name, client.Addr)
+		s.kick(client, c, fmt.Sprintf("replaced by login from %s", c.RemoteAddr().String()))
 	}
-	return c.WriteJSON(cmd)
+	return name, result, nil
+}
+
+func (s *STPServer) OnLogin(d *Dispatcher, cmd *STPCmd) (*Client, error) {
+	cli, reason, err := s.login(d, cmd)
+	s.metrics.login(reason)
+	return cli, err
 }
 
-func (s *STPServer) OnLogin(c *websocket.Conn, data []byte) (*Client, error) {
+// login 登录失败时同时返回失败原因
+func (s *STPServer) login(d *Dispatcher, cmd *STPCmd) (cli *Client, reason string, err error) {
+	c := d.conn
 	loginData := STPLoginData{}
-	err := json.Unmarshal(data, &loginData)
+	err = json.Unmarshal(cmd.Data, &loginData)
 	if err != nil {
 		log.Println(err.Error())
-		return nil, err
+		return nil, loginFailBadRequest, err
+	}
+	err = ValidClientName(loginData.Name)
+	if err != nil {
+		return nil, loginFailName, err
 	}
-	if loginData.AuthKey != s.authKey {
+	startPort, endPort := s.portMgr.StartPort, s.portMgr.EndPort
+	if s.tokens != nil {
+		token, err := s.tokens.Verify(loginData.Name, loginData.AuthKey)
+		if err != nil {
+			log.Println("verify token error:", loginData.Name, err.Error())
+			return nil, loginFailAuth, err
+		}
+		if token.PortRange != "" {
+			startPort, endPort, err = ParsePortRange(token.PortRange)
+			if err != nil {
+				log.Println("token port range error:", loginData.Name, err.Error())
+				return nil, loginFailAuth, err
+			}
+		}
+	} else if loginData.AuthKey != s.authKey {
 		log.Println("invalid auth key")
-		return nil, errors.New("invalid auth key")
+		return nil, loginFailAuth, errors.New("invalid auth key")
 	}
-
-	port := s.portMgr.AssginPort()
-	if port == "" {
-		log.Println("port not enough")
-		return nil, errors.New("port not enough")
+	name, nameResult, err := s.resolveName(c, loginData.Name)
+	if err != nil {
+		return nil, loginFailDupName, err
 	}
+	if nameResult != NameAccepted {
+		log.Println("client name", loginData.Name, nameResult, "as", name)
+	}
+	defer func() {
+		if err != nil {
+			s.cliMgr.ReleaseName(name)
+		}
+	}()
 
-	log.Println("login 200")
-	respData := make(map[string]interface{})
-	respData["port"] = port
-	respData["privateKey"] = s.privateKey
-	respData["publicKey"] = s.publicKey
-	respData["sshUser"] = s.sshUser
-	respData["sshAddr"] = s.sshAddr
-	resp := STPResp{
-		Status: 200,
-		Data:   respData,
+	// old clients don't send targets, they forward one port chosen by themselves
+	targets := loginData.Targets
+	if len(targets) == 0 {
+		targets = []*STPTarget{{}}
 	}
-	err = c.WriteJSON(resp)
-	if err != nil {
-		return nil, err
+	if len(targets) > MaxTargets {
+		return nil, loginFailTargets, fmt.Errorf("too many forward targets, max %d", MaxTargets)
 	}
-	cli := &Client{
-		Name:      loginData.Name,
-		Port:      port,
+
+	cli = &Client{
+		Name:      name,
+		Targets:   targets,
+		Transport: TransportSSH,
 		Addr:      c.RemoteAddr().String(),
 		LoginTime: time.Now().Unix(),
+		LastSeen:  time.Now().Unix(),
 		conn:      c,
+		disp:      d,
+		portStart: startPort,
+		portEnd:   endPort,
+	}
+	if loginData.Transport == TransportWs {
+		if !c.Supports(FeatureWsTransport) {
+			return nil, loginFailTransport, errors.New("ws transport not negotiated, send hello first")
+		}
+		cli.Transport = TransportWs
+		// 在读循环中创建, 按需隧道打开时直接使用
+		if c.mux == nil {
+			NewWsMux(c, nil)
+		}
+	}
+	resp := &STPLoginResp{
+		Ports:      targets,
+		PublicKey:  s.publicKey,
+		Name:       name,
+		NameResult: nameResult,
+		Transport:  cli.Transport,
+	}
+	if c.Supports(FeatureRateLimit) {
+		resp.RateLimit = s.rateLimit(name)
+	}
+	if loginData.OnDemand && c.Supports(FeatureOnDemand) {
+		// 按需隧道登录时不分配端口, Activate 时再打开
+		for _, target := range targets {
+			target.Port = ""
+		}
+		cli.OnDemand = true
+		resp.OnDemand = true
+	} else {
+		err = s.openTunnel(cli, targets, resp)
+		if err != nil {
+			return nil, loginFailTunnel, err
+		}
+		cli.Port = resp.Port
+		cli.Active = true
+	}
+
+	log.Println("login 200")
+	err = d.Reply(cmd, resp)
+	if err != nil {
+		s.closeTunnel(cli)
+		return nil, loginFailReply, err
+	}
+	return cli, "", nil
+}
+
+// openTunnel 给 targets 分配端口并准备转发, ssh 转发时授权临时凭证, 客户端需要的信息写入 resp
+// cli 已经在线时需要持有 cli.tunnelLock
+func (s *STPServer) openTunnel(cli *Client, targets []*STPTarget, resp *STPLoginResp) error {
+	err := s.assginPorts(cli.Name, targets, cli.portStart, cli.portEnd)
+	if err != nil {
+		s.metrics.portFailure()
+		log.Println("assgin port error:", err.Error())
+		return err
+	}
+	ports := []string{}
+	for _, target := range targets {
+		ports = append(ports, target.Port)
+	}
+	resp.Port = ports[0]
+	resp.Ports = targets
+	resp.Transport = cli.Transport
+	if cli.Transport == TransportWs {
+		err = s.startWsForward(cli, targets)
+		if err != nil {
+			s.releasePorts(targets)
+			return err
+		}
+		return nil
+	}
+	cred, err := NewTunnelCredential(ports)
+	if err != nil {
+		s.releasePorts(targets)
+		return err
+	}
+	cred.Client = cli.Name
+	err = s.authorizer.Authorize(cred)
+	if err != nil {
+		s.releasePorts(targets)
+		return err
+	}
+	cli.cred = cred
+	s.credLock.Lock()
+	s.creds[cred] = cli
+	s.credLock.Unlock()
+	resp.PrivateKey = cred.PrivateKey
+	resp.SSHUser = s.sshUser
+	resp.SSHAddr = s.sshAddr
+	resp.HostKeys = s.hostKeys
+	return nil
+}
+
+// closeTunnel 关闭转发, 回收端口和凭证, cli 已经在线时需要持有 cli.tunnelLock
+// 正在等待客户端响应 activate 时, activate 收到响应后返回错误
+func (s *STPServer) closeTunnel(cli *Client) {
+	s.closeWsForward(cli)
+	s.releasePorts(cli.Targets)
+	s.revokeCredential(cli)
+	if cli.cred != nil {
+		s.credLock.Lock()
+		delete(s.creds, cli.cred)
+		s.credLock.Unlock()
+	}
+	cli.cred = nil
+	if cli.activating != nil {
+		close(cli.activating)
+		cli.activating = nil
+	}
+}
+
+// credClient 使用凭证 cred 的客户端, 隧道已经关闭时返回 nil
+func (s *STPServer) credClient(cred *TunnelCredential) *Client {
+	s.credLock.Lock()
+	defer s.credLock.Unlock()
+	return s.creds[cred]
+}
+
+// startWsForward 服务端监听分配的端口, 每个连接在控制连接上打开一个 stream 交给客户端转发
+func (s *STPServer) startWsForward(cli *Client, targets []*STPTarget) error {
+	mux := cli.conn.mux
+	for _, target := range targets {
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", target.Port))
+		if err != nil {
+			s.closeWsForward(cli)
+			return err
+		}
+		cli.listeners = append(cli.listeners, listener)
+		go func(listener net.Listener, port string) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				stream, err := mux.Open(port)
+				if err != nil {
+					log.Println("open ws stream error", err.Error())
+					conn.Close()
+					continue
+				}
+				go handleClient(s.metrics.countConn(cli.Name, conn), stream, nil)
+			}
+		}(listener, target.Port)
+	}
+	return nil
+}
+
+func (s *STPServer) closeWsForward(cli *Client) {
+	for _, listener := range cli.listeners {
+		listener.Close()
+	}
+	cli.listeners = nil
+}
+
+// assginPorts 给每个转发目标分配端口, 固定端口只用于第一个目标, 其余优先使用上次分配的端口
+// 固定端口不在 startPort..endPort 内时拒绝分配
+func (s *STPServer) assginPorts(name string, targets []*STPTarget, startPort, endPort int) error {
+	last := make(map[string]int)
+	for _, target := range s.cliMgr.LastTargets(name) {
+		if port, err := strconv.Atoi(target.Port); err == nil {
+			last[target.Key()] = port
+		}
+	}
+	s.cfgLock.RLock()
+	pinned, isPinned := s.pinPorts[name]
+	s.cfgLock.RUnlock()
+	for i, target := range targets {
+		target.Port = ""
+		if isPinned && i == 0 {
+			if pinned < startPort || pinned > endPort {
+				s.releasePorts(targets[:i])
+				return fmt.Errorf("pinned port %d out of range %d-%d", pinned, startPort, endPort)
+			}
+			target.Port = s.portMgr.TakePort(pinned, name)
+			if target.Port == "" {
+				s.releasePorts(targets[:i])
+				return fmt.Errorf("pinned port %d not available", pinned)
+			}
+			continue
+		}
+		if prefer, ok := last[target.Key()]; ok && prefer >= startPort && prefer <= endPort {
+			target.Port = s.portMgr.TakePort(prefer, name)
+		}
+		if target.Port == "" {
+			target.Port = s.portMgr.AssginPortInRange(startPort, endPort)
+		}
+		if target.Port == "" {
+			s.releasePorts(targets[:i])
+			return errors.New("port not enough")
+		}
+	}
+	return nil
+}
+
+func (s *STPServer) releasePorts(targets []*STPTarget) {
+	for _, target := range targets {
+		if target.Port != "" {
+			s.portMgr.ReleasePort(target.Port)
+		}
+	}
+}
+
+// revokeCredential 收回客户端登录时授权的临时凭证
+func (s *STPServer) revokeCredential(client *Client) {
+	if client.cred == nil {
+		return
+	}
+	err := s.authorizer.Revoke(client.cred)
+	if err != nil {
+		log.Println("revoke tunnel credential error", err.Error())
 	}
-	return cli, nil
 }
 
 type Port struct {
-	port int
-	used bool
+	port  int
+	used  bool
+	owner string // 固定给某个客户端的端口
 }
 
 type PortManager struct {
@@ -482,7 +1580,7 @@ type PortManager struct {
 func NewPortManager(startPort, endPort int) *PortManager {
 	ports := []*Port{}
 	for i := startPort; i <= endPort; i++ {
-		ports = append(ports, &Port{i, false})
+		ports = append(ports, &Port{port: i})
 	}
 	log.Printf("port range %d-%d\n", startPort, endPort)
 	return &PortManager{StartPort: startPort, EndPort: endPort, ports: ports, idx: 0}
@@ -490,14 +1588,30 @@ func NewPortManager(startPort, endPort int) *PortManager {
 
 // AssginPort 给远程客户端分配绑定端口
 func (pm *PortManager) AssginPort() string {
+	return pm.AssginPortInRange(pm.StartPort, pm.EndPort)
+}
+
+// AssginPortInRange 在 [start, end] 范围内分配端口
+func (pm *PortManager) AssginPortInRange(start, end int) string {
 	pm.lock.Lock()
 	defer pm.lock.Unlock()
-	startIdx := pm.idx
-	for i := pm.idx + 1; i != startIdx; i++ {
-		// loop and keep in range
-		i = i % len(pm.ports)
+	// keep in range
+	if start < pm.StartPort {
+		start = pm.StartPort
+	}
+	if end > pm.EndPort {
+		end = pm.EndPort
+	}
+	if start > end {
+		return ""
+	}
+	base := start - pm.StartPort
+	size := end - start + 1
+	for n := 1; n <= size; n++ {
+		// loop from last assgined port
+		i := base + ((pm.idx-base+n)%size+size)%size
 		p := pm.ports[i]
-		if p.used {
+		if p.used || p.owner != "" {
 			continue
 		}
 		// double check
@@ -513,6 +1627,57 @@ func (pm *PortManager) AssginPort() string {
 	return ""
 }
 
+// Reserve 把端口固定给指定客户端, 不再参与自动分配
+func (pm *PortManager) Reserve(port int, name string) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if port < pm.StartPort || port > pm.EndPort {
+		return false
+	}
+	pm.ports[port-pm.StartPort].owner = name
+	return true
+}
+
+// TakePort 给客户端分配指定端口, 端口被占用或固定给其他客户端时返回空
+func (pm *PortManager) TakePort(port int, name string) string {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if port < pm.StartPort || port > pm.EndPort {
+		return ""
+	}
+	p := pm.ports[port-pm.StartPort]
+	if p.used || (p.owner != "" && p.owner != name) {
+		return ""
+	}
+	if online, _ := pm.PingPort(p.port); online {
+		return ""
+	}
+	p.used = true
+	return strconv.Itoa(p.port)
+}
+
+// ClearReserved 取消所有固定端口
+func (pm *PortManager) ClearReserved() {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	for _, p := range pm.ports {
+		p.owner = ""
+	}
+}
+
+// Usage 返回已分配或固定的端口
+func (pm *PortManager) Usage() []Port {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	usage := []Port{}
+	for _, p := range pm.ports {
+		if p.used || p.owner != "" {
+			usage = append(usage, *p)
+		}
+	}
+	return usage
+}
+
 // ReleasePort 释放端口
 func (pm *PortManager) ReleasePort(port string) {
 	pm.lock.Lock()
@@ -547,3 +1712,24 @@ func (pm *PortManager) PingPort(port int) (online bool, err error) {
 	online = true
 	return
 }
+
+// ParsePortRange 解析 "10001-20000" 格式的端口范围
+func ParsePortRange(portRange string) (start int, end int, err error) {
+	startEnd := strings.Split(portRange, "-")
+	if len(startEnd) != 2 {
+		err = fmt.Errorf("invalid port range, %s", portRange)
+		return
+	}
+	start, err = strconv.Atoi(strings.TrimSpace(startEnd[0]))
+	if err != nil {
+		return
+	}
+	end, err = strconv.Atoi(strings.TrimSpace(startEnd[1]))
+	if err != nil {
+		return
+	}
+	if start > end {
+		err = fmt.Errorf("invalid port range, %s", portRange)
+	}
+	return
+}
@@ -0,0 +1,374 @@
+package stp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeAuthorizer 只记录授权的凭证, 不写 authorized_keys
+type fakeAuthorizer struct {
+	lock  sync.Mutex
+	creds map[*TunnelCredential]bool
+}
+
+func newFakeAuthorizer() *fakeAuthorizer {
+	return &fakeAuthorizer{creds: make(map[*TunnelCredential]bool)}
+}
+
+func (fa *fakeAuthorizer) Authorize(cred *TunnelCredential) error {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	fa.creds[cred] = true
+	return nil
+}
+
+func (fa *fakeAuthorizer) Revoke(cred *TunnelCredential) error {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	if !fa.creds[cred] {
+		return fmt.Errorf("credential %s not authorized", cred.Ports)
+	}
+	delete(fa.creds, cred)
+	return nil
+}
+
+func (fa *fakeAuthorizer) count() int {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	return len(fa.creds)
+}
+
+// newTestServer 使用 fakeAuthorizer 的 stpsrv, 返回 ws 地址
+func newTestServer(t *testing.T, portRange string) (*STPServer, *fakeAuthorizer, string) {
+	s := NewSTPServer("testkey", "127.0.0.1:0", "127.0.0.1:22", "", "stp", portRange)
+	fa := newFakeAuthorizer()
+	s.authorizer = fa
+	ts := httptest.NewServer(http.HandlerFunc(s.WsHandler))
+	t.Cleanup(ts.Close)
+	return s, fa, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// dialLogin 连接并登录, 返回的 dispatcher 已经在读循环中
+func dialLogin(url, name string) (*Dispatcher, *STPLoginResp, error) {
+	return dialLoginData(url, &STPLoginData{AuthKey: "testkey", Name: name}, nil)
+}
+
+// dialLoginData 使用 login 登录, handlers 处理服务端下发的其他命令
+func dialLoginData(url string, login *STPLoginData, handlers map[string]func(d *Dispatcher, cmd *STPCmd) error) (*Dispatcher, *STPLoginResp, error) {
+	wsconn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := NewDispatcher(NewControlConn(wsconn))
+	for _, cmd := range []string{"relogin", "kick", "rateLimit", "deactivate"} {
+		d.Handle(cmd, func(cmd *STPCmd) error { return nil })
+	}
+	for cmd, handler := range handlers {
+		handler := handler
+		d.Handle(cmd, func(cmd *STPCmd) error { return handler(d, cmd) })
+	}
+	go d.Run()
+	err = d.Hello()
+	if err != nil {
+		wsconn.Close()
+		return nil, nil, err
+	}
+	resp := &STPLoginResp{}
+	err = d.Call("login", login, resp)
+	if err != nil {
+		wsconn.Close()
+		return nil, nil, err
+	}
+	return d, resp, nil
+}
+
+// TestClientManagerConcurrent 登录、下线、端口探测、更新隧道和 List 同时进行, 用 -race 运行
+func TestClientManagerConcurrent(t *testing.T) {
+	s, fa, url := newTestServer(t, "47100-47199")
+	s.EnablePortProbe(time.Hour, 8, 0)
+	stop := make(chan bool)
+	var bg sync.WaitGroup
+	loop := func(fn func()) {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fn()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	loop(func() {
+		for i, client := range s.cliMgr.Sessions() {
+			if i%2 == 0 {
+				s.setOffline(client, "offline by test", true)
+			}
+		}
+	})
+	loop(s.probePorts)
+	loop(func() {
+		for _, client := range s.cliMgr.Sessions() {
+			client.tunnelLock.Lock()
+			s.cliMgr.SetTunnel(client, client.Targets, true)
+			client.tunnelLock.Unlock()
+		}
+	})
+	loop(func() {
+		if _, err := json.Marshal(s.cliMgr.List()); err != nil {
+			t.Error(err)
+		}
+		s.portPool()
+		s.writeMetrics(ioutil.Discard)
+	})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				d, _, err := dialLogin(url, fmt.Sprintf("race%d", g))
+				if err != nil {
+					// 上一个连接的会话还没有下线
+					continue
+				}
+				time.Sleep(2 * time.Millisecond)
+				d.conn.Close()
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	bg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.cliMgr.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(s.cliMgr.Sessions()); n != 0 {
+		t.Fatalf("%d sessions still online", n)
+	}
+	if used := s.portPool().Used; used != 0 {
+		t.Fatalf("%d ports still assigned", used)
+	}
+	if n := fa.count(); n != 0 {
+		t.Fatalf("%d credentials not revoked", n)
+	}
+}
+
+// TestLoginDupNameConcurrent 同名客户端同时登录, reject 只有一个成功, suffix 每个名字都不同且不超长
+func TestLoginDupNameConcurrent(t *testing.T) {
+	base := strings.Repeat("n", maxClientName)
+	for _, policy := range []string{DupNameReject, DupNameSuffix} {
+		s, _, url := newTestServer(t, "47200-47299")
+		if err := s.DupNamePolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+		var lock sync.Mutex
+		names := make(map[string]int)
+		var wg sync.WaitGroup
+		for i := 0; i < 12; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d, resp, err := dialLogin(url, base)
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { d.conn.Close() })
+				lock.Lock()
+				names[resp.Name]++
+				lock.Unlock()
+			}()
+		}
+		wg.Wait()
+		switch policy {
+		case DupNameReject:
+			if len(names) != 1 || names[base] != 1 {
+				t.Fatalf("reject: logins %v, expected one %s", names, base)
+			}
+		case DupNameSuffix:
+			if len(names) != 12 {
+				t.Fatalf("suffix: %d distinct names, expected 12: %v", len(names), names)
+			}
+			for name, n := range names {
+				if n != 1 || ValidClientName(name) != nil {
+					t.Fatalf("suffix: name %s used %d times, valid %v", name, n, ValidClientName(name))
+				}
+			}
+		}
+		if n := len(s.cliMgr.Sessions()); n != len(names) {
+			t.Fatalf("%s: %d sessions, %d logins", policy, n, len(names))
+		}
+	}
+}
+
+// TestAssignPinnedPortRange token 限制的端口范围外的固定端口不能分配
+func TestAssignPinnedPortRange(t *testing.T) {
+	s := NewSTPServer("testkey", "127.0.0.1:0", "127.0.0.1:22", "", "stp", "47400-47409")
+	s.PinPorts(map[string]int{"pinned": 47409})
+	targets := []*STPTarget{{Addr: "localhost:22"}, {Label: "web", Addr: "localhost:80"}}
+	if err := s.assginPorts("pinned", targets, 47400, 47404); err == nil {
+		t.Fatalf("pinned port out of range assigned: %s", targets[0].Port)
+	}
+	if used := s.portPool().Used; used != 0 {
+		t.Fatalf("%d ports still assigned", used)
+	}
+	if err := s.assginPorts("pinned", targets, 47400, 47409); err != nil {
+		t.Fatal(err)
+	}
+	if targets[0].Port != "47409" || targets[1].Port == "" {
+		t.Fatalf("ports %s, %s", targets[0].Port, targets[1].Port)
+	}
+}
+
+// countStore 只统计保存次数
+type countStore struct {
+	lock  sync.Mutex
+	saves int
+}
+
+func (cs *countStore) Load() (map[string]*ClientRecord, error) {
+	return make(map[string]*ClientRecord), nil
+}
+
+func (cs *countStore) Save(records map[string]*ClientRecord) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.saves++
+	return nil
+}
+
+func (cs *countStore) count() int {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.saves
+}
+
+// TestPersistDirty 定时保存只在最后在线时间或流量变化后写状态文件
+func TestPersistDirty(t *testing.T) {
+	cm := NewClientManager()
+	store := &countStore{}
+	if err := cm.UseStore(store); err != nil {
+		t.Fatal(err)
+	}
+	cli := &Client{Name: "dev", Port: "47500", LoginTime: time.Now().Unix() - 60}
+	cm.AddClient(cli)
+	saves := store.count()
+	cm.PersistDirty()
+	if n := store.count(); n != saves {
+		t.Fatalf("%d saves without changes", n-saves)
+	}
+	cli.LastSeen = 0
+	cm.Touch(cli)
+	cm.PersistDirty()
+	cm.PersistDirty()
+	if n := store.count(); n != saves+1 {
+		t.Fatalf("%d saves after touch, expected 1", n-saves)
+	}
+	cm.SetTraffic(cli, &STPTraffic{})
+	cm.PersistDirty()
+	if n := store.count(); n != saves+2 {
+		t.Fatalf("%d saves after traffic, expected 2", n-saves)
+	}
+}
+
+// TestTouchOnDemandRecord 按需客户端没有打开隧道时保留上次的端口, 最后在线时间也要更新
+func TestTouchOnDemandRecord(t *testing.T) {
+	cm := NewClientManager()
+	login := time.Now().Unix() - 60
+	last := &Client{Name: "dev", Port: "47600", LoginTime: login}
+	cm.AddClient(last)
+	cm.DelClient(last)
+	cli := &Client{Name: "dev", OnDemand: true, LoginTime: login}
+	cm.AddClient(cli)
+	cm.SetTunnel(cli, emptyPorts(last.Targets), false)
+	cm.Touch(cli)
+	if cli.LastSeen == login {
+		t.Fatal("session last seen not updated")
+	}
+	record := cm.records["dev"]
+	if record.Port != "47600" || record.LastSeen != cli.LastSeen {
+		t.Fatalf("record port %s last seen %d, expected 47600 %d", record.Port, record.LastSeen, cli.LastSeen)
+	}
+}
+
+// TestActivateUnlocked 等待客户端响应 activate 时不持有 tunnelLock, 下线和其他客户端不受影响
+func TestActivateUnlocked(t *testing.T) {
+	s, fa, url := newTestServer(t, "47700-47709")
+	// slow 收到 activate 后不响应
+	slowConn, _, err := dialLoginData(url, &STPLoginData{AuthKey: "testkey", Name: "slow", OnDemand: true}, map[string]func(*Dispatcher, *STPCmd) error{
+		"activate": func(d *Dispatcher, cmd *STPCmd) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowConn.conn.Close()
+	_, _, err = dialLoginData(url, &STPLoginData{AuthKey: "testkey", Name: "fast", OnDemand: true}, map[string]func(*Dispatcher, *STPCmd) error{
+		"activate": func(d *Dispatcher, cmd *STPCmd) error { return d.Reply(cmd, nil) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, _ := FindClient(s.cliMgr.Sessions(), "slow")
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := s.Activate("slow")
+		slowDone <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.cliMgr.Snapshot(slow).Active && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fast, err := s.Activate("fast")
+	if err != nil || !fast.Active {
+		t.Fatalf("activate fast: %v", err)
+	}
+	fastSession, _ := FindClient(s.cliMgr.Sessions(), "fast")
+	fastSession.tunnelLock.Lock()
+	cred := fastSession.cred
+	fastSession.tunnelLock.Unlock()
+	if s.credClient(cred) != fastSession {
+		t.Fatal("credential of fast not indexed")
+	}
+
+	offline := make(chan bool)
+	go func() {
+		s.setOffline(slow, "offline by test", false)
+		close(offline)
+	}()
+	select {
+	case <-offline:
+	case <-time.After(2 * time.Second):
+		t.Fatal("setOffline blocked by pending activate")
+	}
+	slowConn.conn.Close()
+	select {
+	case err := <-slowDone:
+		if err == nil {
+			t.Fatal("activate of offline client succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("activate not finished after connection closed")
+	}
+	if used := s.portPool().Used; used != 1 {
+		t.Fatalf("%d ports assigned, expected 1 for fast", used)
+	}
+	if n := fa.count(); n != 1 {
+		t.Fatalf("%d credentials authorized, expected 1 for fast", n)
+	}
+}
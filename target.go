@@ -0,0 +1,71 @@
+package stp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MaxTargets 单个客户端最多转发的目标数
+const MaxTargets = 16
+
+// STPTarget 客户端转发目标
+type STPTarget struct {
+	Label string `json:"label,omitempty"`
+	Addr  string `json:"addr"`           // 客户端本地 host:port
+	Port  string `json:"port,omitempty"` // 服务端分配的端口
+}
+
+// Key 同一客户端内区分转发目标, 用于重新登录时找回上次的端口
+func (t *STPTarget) Key() string {
+	if t.Label != "" {
+		return t.Label
+	}
+	return t.Addr
+}
+
+func (t *STPTarget) String() string {
+	if t.Label != "" {
+		return fmt.Sprintf("%s=%s", t.Label, t.Addr)
+	}
+	return t.Addr
+}
+
+// ParseTargets 解析 "22,web=80,cam=192.168.1.20:554" 格式的转发目标列表
+// 只有端口时转发到 localhost
+func ParseTargets(s string) ([]*STPTarget, error) {
+	targets := []*STPTarget{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		target := &STPTarget{}
+		if idx := strings.Index(item, "="); idx != -1 {
+			target.Label = strings.TrimSpace(item[:idx])
+			item = strings.TrimSpace(item[idx+1:])
+		}
+		host, port := "localhost", item
+		if strings.Contains(item, ":") {
+			var err error
+			host, port, err = net.SplitHostPort(item)
+			if err != nil || host == "" {
+				return nil, fmt.Errorf("invalid forward target %s", item)
+			}
+		}
+		portInt, err := strconv.Atoi(port)
+		if err != nil || portInt <= 0 || portInt > 65535 {
+			return nil, fmt.Errorf("invalid forward port %s", item)
+		}
+		target.Addr = net.JoinHostPort(host, port)
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no forward target")
+	}
+	if len(targets) > MaxTargets {
+		return nil, fmt.Errorf("too many forward targets, max %d", MaxTargets)
+	}
+	return targets, nil
+}
@@ -0,0 +1,109 @@
+package stp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// CertPin 计算证书公钥的 sha256 指纹, base64 编码, 同 HPKP pin-sha256
+func CertPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CertFilePin 计算证书文件中第一个证书的指纹
+func CertFilePin(certFile string) (string, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("no pem certificate in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return CertPin(cert), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no pem certificate in %s", caFile)
+	}
+	return pool, nil
+}
+
+// NewClientTLSConfig stpcli 连接 wss 使用的 tls 配置
+// caFile 为空时使用系统 CA; 只指定 pin 时不校验证书链, 只校验证书公钥指纹;
+// certFile, keyFile 为双向认证使用的客户端证书
+func NewClientTLSConfig(caFile, certFile, keyFile, pin string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if pin != "" {
+		if caFile == "" {
+			cfg.InsecureSkipVerify = true
+		}
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server certificate missing")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if got := CertPin(cert); got != pin {
+				return fmt.Errorf("server certificate pin mismatch: got %s, expected %s", got, pin)
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// NewServerTLSConfig stpsrv 提供 wss 使用的 tls 配置
+// clientCAFile 不为空时校验客户端证书, 是否必须由 websocket 登录时检查, 方便本机管理接口不带证书访问
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
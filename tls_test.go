@@ -0,0 +1,226 @@
+package stp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+var testSerial int64
+
+// newTestCert 生成证书写入 dir, parent 为 nil 时生成自签名 CA
+func newTestCert(t *testing.T, dir, name string, parent *testCert, server bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if server {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		} else {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	writeTestPEM(t, tc.certFile, "CERTIFICATE", der)
+	writeTestPEM(t, tc.keyFile, "EC PRIVATE KEY", keyDer)
+	return tc
+}
+
+func writeTestPEM(t *testing.T, path, typ string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSServer 返回 https 地址, 响应内容为客户端证书的 CommonName
+func startTLSServer(t *testing.T, server *testCert, clientCA string) string {
+	cfg, err := NewServerTLSConfig(server.certFile, server.keyFile, clientCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	ts.TLS = cfg
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func tlsGet(url string, cfg *tls.Config) (string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestClientTLSConfigCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, false)
+	other := newTestCert(t, dir, "other", nil, false)
+	url := startTLSServer(t, newTestCert(t, dir, "server", ca, true), "")
+
+	cfg, err := NewClientTLSConfig(ca.certFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsGet(url, cfg); err != nil {
+		t.Fatalf("verify with ca: %v", err)
+	}
+
+	cfg, err = NewClientTLSConfig(other.certFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsGet(url, cfg); err == nil {
+		t.Fatal("expected unknown authority error with other ca")
+	}
+
+	if _, err := NewClientTLSConfig(filepath.Join(dir, "missing.crt"), "", "", ""); err == nil {
+		t.Fatal("expected error for missing ca file")
+	}
+}
+
+func TestClientTLSConfigMutual(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, false)
+	other := newTestCert(t, dir, "other", nil, false)
+	url := startTLSServer(t, newTestCert(t, dir, "server", ca, true), ca.certFile)
+
+	client := newTestCert(t, dir, "client", ca, false)
+	cfg, err := NewClientTLSConfig(ca.certFile, client.certFile, client.keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := tlsGet(url, cfg)
+	if err != nil {
+		t.Fatalf("mutual tls: %v", err)
+	}
+	if body != "client" {
+		t.Fatalf("server saw client cert %q, expected client", body)
+	}
+
+	// 不带证书可以连接, 是否必须由登录时检查
+	cfg, err = NewClientTLSConfig(ca.certFile, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = tlsGet(url, cfg)
+	if err != nil || body != "" {
+		t.Fatalf("without client cert: body %q err %v", body, err)
+	}
+
+	stranger := newTestCert(t, dir, "stranger", other, false)
+	cfg, err = NewClientTLSConfig(ca.certFile, stranger.certFile, stranger.keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 客户端不会发送服务端 CA 之外的证书, 服务端也不能把它当成已认证
+	body, err = tlsGet(url, cfg)
+	if err == nil && body != "" {
+		t.Fatalf("client cert from other ca accepted as %q", body)
+	}
+}
+
+func TestClientTLSConfigPin(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, false)
+	server := newTestCert(t, dir, "server", ca, true)
+	url := startTLSServer(t, server, "")
+
+	pin, err := CertFilePin(server.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin != CertPin(server.cert) {
+		t.Fatalf("file pin %s, cert pin %s", pin, CertPin(server.cert))
+	}
+
+	// 只指定 pin 时不校验证书链
+	cfg, err := NewClientTLSConfig("", "", "", pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsGet(url, cfg); err != nil {
+		t.Fatalf("pin match: %v", err)
+	}
+
+	cfg, err = NewClientTLSConfig("", "", "", CertPin(ca.cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tlsGet(url, cfg)
+	if err == nil || !strings.Contains(err.Error(), "pin mismatch") {
+		t.Fatalf("expected pin mismatch, got %v", err)
+	}
+
+	// ca 和 pin 同时指定时两者都要通过
+	other := newTestCert(t, dir, "other", nil, false)
+	cfg, err = NewClientTLSConfig(other.certFile, "", "", pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsGet(url, cfg); err == nil {
+		t.Fatal("expected chain error even though pin matches")
+	}
+}
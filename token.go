@@ -0,0 +1,163 @@
+package stp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Token 客户端登录凭证，文件中只保存 token 的 sha256
+type Token struct {
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	CreateAt  int64  `json:"createAt"`
+	ExpireAt  int64  `json:"expireAt"`  // 0 永不过期
+	PortRange string `json:"portRange"` // 允许分配的端口范围, 空为不限制
+}
+
+func (t *Token) Expired() bool {
+	return t.ExpireAt != 0 && time.Now().Unix() > t.ExpireAt
+}
+
+// TokenStore 按客户端名保存登录凭证
+// 每次读写都直接操作文件，stpsrv 运行中签发或吊销立即生效
+type TokenStore struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewTokenStore(path string) *TokenStore {
+	return &TokenStore{path: path}
+}
+
+func (ts *TokenStore) load() (map[string]*Token, error) {
+	tokens := make(map[string]*Token)
+	data, err := ioutil.ReadFile(ts.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tokens, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return tokens, nil
+	}
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (ts *TokenStore) save(tokens map[string]*Token) error {
+	data, err := json.MarshalIndent(tokens, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ts.path, data, 0600)
+}
+
+// Issue 给客户端签发新 token, 已存在则覆盖, 返回明文 token
+func (ts *TokenStore) Issue(name string, ttl time.Duration, portRange string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty client name")
+	}
+	if portRange != "" {
+		if _, _, err := ParsePortRange(portRange); err != nil {
+			return "", err
+		}
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	tokens, err := ts.load()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 24)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+	now := time.Now()
+	token := &Token{
+		Name:      name,
+		Hash:      hashToken(secret),
+		CreateAt:  now.Unix(),
+		PortRange: portRange,
+	}
+	if ttl > 0 {
+		token.ExpireAt = now.Add(ttl).Unix()
+	}
+	tokens[name] = token
+	err = ts.save(tokens)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Revoke 吊销客户端 token
+func (ts *TokenStore) Revoke(name string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	tokens, err := ts.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[name]; !ok {
+		return errors.New("token not found")
+	}
+	delete(tokens, name)
+	return ts.save(tokens)
+}
+
+// List 按客户端名排序返回所有 token
+func (ts *TokenStore) List() ([]*Token, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	tokens, err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	list := []*Token{}
+	for _, token := range tokens {
+		list = append(list, token)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Verify 校验客户端登录 token
+func (ts *TokenStore) Verify(name, secret string) (*Token, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	tokens, err := ts.load()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := tokens[name]
+	if !ok {
+		return nil, errors.New("unknown client name")
+	}
+	if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashToken(secret))) != 1 {
+		return nil, errors.New("invalid auth key")
+	}
+	if token.Expired() {
+		return nil, errors.New("auth key expired")
+	}
+	return token, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,186 @@
+package stp
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// stpcli 上报流量的间隔
+	trafficInterval = 30 * time.Second
+	// 上报中保留的最近结束的连接数
+	recentTunnels = 10
+)
+
+// STPTunnelStat 一个转发连接的流量, in 为访问方发往客户端本地服务, out 为本地服务返回
+type STPTunnelStat struct {
+	Peer     string `json:"peer"`
+	Target   string `json:"target"`
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+	Start    int64  `json:"start"`
+	Duration int64  `json:"duration"` // 秒, 进行中的连接为已经持续的时间
+	Active   bool   `json:"active"`
+}
+
+// STPTraffic stpcli 启动以来的流量, 定期上报给 stpsrv
+type STPTraffic struct {
+	Since    int64           `json:"since"`
+	BytesIn  int64           `json:"bytesIn"`
+	BytesOut int64           `json:"bytesOut"`
+	Conns    int64           `json:"conns"`    // 累计连接数
+	Active   int             `json:"active"`   // 进行中的连接数
+	Duration int64           `json:"duration"` // 已结束连接的总时长, 秒
+	Tunnels  []STPTunnelStat `json:"tunnels"`  // 进行中的连接和最近结束的连接
+	Report   int64           `json:"report"`   // 上报时间
+}
+
+// trafficStats 客户端汇总所有转发连接的流量, 传输中实时累加
+type trafficStats struct {
+	lock     sync.Mutex
+	since    time.Time
+	in       int64
+	out      int64
+	conns    int64
+	duration time.Duration
+	active   map[*tunnelStat]bool
+	recent   []STPTunnelStat
+}
+
+type tunnelStat struct {
+	stats  *trafficStats
+	peer   string
+	target string
+	start  time.Time
+	in     int64
+	out    int64
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{since: time.Now(), active: make(map[*tunnelStat]bool)}
+}
+
+// open 开始统计一个转发连接, t 为 nil 时不统计
+func (t *trafficStats) open(peer, target string) *tunnelStat {
+	if t == nil {
+		return nil
+	}
+	st := &tunnelStat{stats: t, peer: peer, target: target, start: time.Now()}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conns++
+	t.active[st] = true
+	return st
+}
+
+func (st *tunnelStat) add(in, out int64) {
+	if st == nil {
+		return
+	}
+	t := st.stats
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	st.in += in
+	st.out += out
+	t.in += in
+	t.out += out
+}
+
+// close 连接结束, 放入最近结束的连接
+func (st *tunnelStat) close() {
+	if st == nil {
+		return
+	}
+	t := st.stats
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.active[st] {
+		return
+	}
+	delete(t.active, st)
+	t.duration += time.Since(st.start)
+	t.recent = append(t.recent, st.stat(false))
+	if len(t.recent) > recentTunnels {
+		t.recent = t.recent[len(t.recent)-recentTunnels:]
+	}
+	log.Printf("tunnel conn closed: %s -> %s, in %d out %d bytes in %s", st.peer, st.target, st.in, st.out, time.Since(st.start).Round(time.Second))
+}
+
+// stat 需要持有 trafficStats 的锁
+func (st *tunnelStat) stat(active bool) STPTunnelStat {
+	return STPTunnelStat{
+		Peer:     st.peer,
+		Target:   st.target,
+		BytesIn:  st.in,
+		BytesOut: st.out,
+		Start:    st.start.Unix(),
+		Duration: int64(time.Since(st.start) / time.Second),
+		Active:   active,
+	}
+}
+
+// report 当前的汇总, 进行中的连接按开始时间排在最近结束的连接之后
+func (t *trafficStats) report() *STPTraffic {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	traffic := &STPTraffic{
+		Since:    t.since.Unix(),
+		BytesIn:  t.in,
+		BytesOut: t.out,
+		Conns:    t.conns,
+		Active:   len(t.active),
+		Duration: int64(t.duration / time.Second),
+		Tunnels:  append([]STPTunnelStat{}, t.recent...),
+		Report:   time.Now().Unix(),
+	}
+	active := []STPTunnelStat{}
+	for st := range t.active {
+		active = append(active, st.stat(true))
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Start < active[j].Start })
+	traffic.Tunnels = append(traffic.Tunnels, active...)
+	return traffic
+}
+
+// statWriter 写入时累加到 tunnelStat
+type statWriter struct {
+	w   io.Writer
+	add func(n int64)
+}
+
+func (sw *statWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if n > 0 {
+		sw.add(int64(n))
+	}
+	return n, err
+}
+
+// reportTraffic 定期上报流量, 控制连接断开后返回
+func (s *STPClient) reportTraffic(disp *Dispatcher) {
+	ticker := time.NewTicker(trafficInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := disp.Send("traffic", s.traffic.report())
+		if err != nil {
+			return
+		}
+	}
+}
+
+// onTraffic 服务端保存客户端上报的流量
+func (s *STPServer) onTraffic(cmd *STPCmd, sessions []*Client) error {
+	traffic := &STPTraffic{}
+	err := json.Unmarshal(cmd.Data, traffic)
+	if err != nil {
+		return err
+	}
+	for _, client := range sessions {
+		s.cliMgr.SetTraffic(client, traffic)
+	}
+	return nil
+}
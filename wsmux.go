@@ -0,0 +1,281 @@
+package stp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	frameOpen   byte = 1
+	frameData   byte = 2
+	frameClose  byte = 3
+	frameWindow byte = 4
+
+	frameHeaderSize = 5
+	streamWindow    = 256 * 1024
+	maxFrameData    = 32 * 1024
+)
+
+// WsMux 在控制连接上复用多条转发连接, 只由服务端打开 stream
+// 帧格式: type(1) + stream id(4) + payload, 每个 stream 有 streamWindow 大小的接收窗口,
+// 接收方读取数据后用 frameWindow 归还额度, 一条慢连接不会阻塞整个控制连接
+type WsMux struct {
+	conn    *ControlConn
+	onOpen  func(stream *WsStream, target string)
+	lock    sync.Mutex
+	streams map[uint32]*WsStream
+	nextID  uint32
+	closed  bool
+}
+
+// NewWsMux onOpen 处理对端打开的 stream, target 为打开时携带的转发目标
+func NewWsMux(conn *ControlConn, onOpen func(stream *WsStream, target string)) *WsMux {
+	mux := &WsMux{
+		conn:    conn,
+		onOpen:  onOpen,
+		streams: make(map[uint32]*WsStream),
+	}
+	conn.mux = mux
+	return mux
+}
+
+func (m *WsMux) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], id)
+	copy(frame[frameHeaderSize:], payload)
+	return m.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// Open 打开一条到对端 target 的 stream
+func (m *WsMux) Open(target string) (*WsStream, error) {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil, errors.New("mux closed")
+	}
+	m.nextID++
+	stream := newWsStream(m, m.nextID)
+	m.streams[stream.id] = stream
+	m.lock.Unlock()
+	err := m.writeFrame(frameOpen, stream.id, []byte(target))
+	if err != nil {
+		m.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (m *WsMux) remove(id uint32) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.streams, id)
+}
+
+func (m *WsMux) handleFrame(frame []byte) {
+	if len(frame) < frameHeaderSize {
+		return
+	}
+	frameType := frame[0]
+	id := binary.BigEndian.Uint32(frame[1:frameHeaderSize])
+	payload := frame[frameHeaderSize:]
+
+	m.lock.Lock()
+	stream, ok := m.streams[id]
+	if !ok && frameType == frameOpen && m.onOpen != nil && !m.closed {
+		stream = newWsStream(m, id)
+		m.streams[id] = stream
+	}
+	m.lock.Unlock()
+
+	switch frameType {
+	case frameOpen:
+		if stream == nil || ok {
+			m.writeFrame(frameClose, id, nil)
+			return
+		}
+		go m.onOpen(stream, string(payload))
+	case frameData:
+		if stream == nil {
+			return
+		}
+		stream.push(payload)
+	case frameWindow:
+		if stream == nil || len(payload) != 4 {
+			return
+		}
+		stream.addCredit(int(binary.BigEndian.Uint32(payload)))
+	case frameClose:
+		if stream == nil {
+			return
+		}
+		m.remove(id)
+		stream.remoteClose()
+	}
+}
+
+// Close 关闭所有 stream
+func (m *WsMux) Close() {
+	m.lock.Lock()
+	m.closed = true
+	streams := m.streams
+	m.streams = make(map[uint32]*WsStream)
+	m.lock.Unlock()
+	for _, stream := range streams {
+		stream.remoteClose()
+	}
+}
+
+// WsStream WsMux 上的一条转发连接
+type WsStream struct {
+	id           uint32
+	mux          *WsMux
+	lock         sync.Mutex
+	cond         *sync.Cond
+	buf          bytes.Buffer
+	credit       int // 剩余发送额度
+	consumed     int // 已读取还未归还的额度
+	closed       bool
+	remoteClosed bool
+}
+
+func newWsStream(mux *WsMux, id uint32) *WsStream {
+	stream := &WsStream{id: id, mux: mux, credit: streamWindow}
+	stream.cond = sync.NewCond(&stream.lock)
+	return stream
+}
+
+func (st *WsStream) push(data []byte) {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return
+	}
+	if st.buf.Len()+len(data) > streamWindow {
+		st.lock.Unlock()
+		log.Println("ws stream window exceeded", st.id)
+		st.Close()
+		return
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	st.lock.Unlock()
+}
+
+func (st *WsStream) addCredit(n int) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.credit += n
+	st.cond.Broadcast()
+}
+
+func (st *WsStream) remoteClose() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.remoteClosed = true
+	st.cond.Broadcast()
+}
+
+func (st *WsStream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	for st.buf.Len() == 0 && !st.closed && !st.remoteClosed {
+		st.cond.Wait()
+	}
+	if st.closed {
+		st.lock.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if st.buf.Len() == 0 {
+		st.lock.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := st.buf.Read(p)
+	st.consumed += n
+	update := 0
+	if st.consumed >= streamWindow/4 {
+		update = st.consumed
+		st.consumed = 0
+	}
+	st.lock.Unlock()
+	if update > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(update))
+		st.mux.writeFrame(frameWindow, st.id, payload)
+	}
+	return n, nil
+}
+
+func (st *WsStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.lock.Lock()
+		for st.credit == 0 && !st.closed && !st.remoteClosed {
+			st.cond.Wait()
+		}
+		if st.closed || st.remoteClosed {
+			st.lock.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := len(p)
+		if n > st.credit {
+			n = st.credit
+		}
+		if n > maxFrameData {
+			n = maxFrameData
+		}
+		st.credit -= n
+		st.lock.Unlock()
+		err := st.mux.writeFrame(frameData, st.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (st *WsStream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	remoteClosed := st.remoteClosed
+	st.cond.Broadcast()
+	st.lock.Unlock()
+	st.mux.remove(st.id)
+	if !remoteClosed {
+		return st.mux.writeFrame(frameClose, st.id, nil)
+	}
+	return nil
+}
+
+func (st *WsStream) LocalAddr() net.Addr {
+	return st.mux.conn.LocalAddr()
+}
+
+func (st *WsStream) RemoteAddr() net.Addr {
+	return st.mux.conn.RemoteAddr()
+}
+
+func (st *WsStream) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (st *WsStream) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (st *WsStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}